@@ -5,9 +5,13 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/dusansimic/jobledger/internal/blob"
 	"github.com/dusansimic/jobledger/internal/db"
 	"github.com/dusansimic/jobledger/internal/handlers"
 	"github.com/dusansimic/jobledger/internal/middleware"
+	"github.com/dusansimic/jobledger/internal/queue"
+	"github.com/dusansimic/jobledger/internal/scheduler"
+	"github.com/dusansimic/jobledger/internal/webhook"
 	"github.com/go-chi/chi/v5"
 )
 
@@ -22,6 +26,8 @@ func main() {
 	database := db.Init()
 	defer database.Close()
 
+	store := blob.Init()
+
 	r := chi.NewRouter()
 
 	r.Use(logMiddleware)
@@ -31,9 +37,27 @@ func main() {
 		r.Use(middleware.RequireAppAuth)
 		r.Get("/job", handlers.GetJob(database))
 		r.Post("/job", handlers.CreateJob(database))
+		r.Post("/job/bulk", handlers.CreateJobs(database))
+		r.Get("/job/{id}", handlers.ReadJob(database))
+		r.Post("/batch", handlers.CreateBatch(database))
+		r.Get("/batch/{id}", handlers.ReadBatch(database))
+		r.Put("/workflow/{name}", handlers.SaveWorkflow(database))
+		r.Get("/workflow/{name}", handlers.ReadWorkflow(database))
+		r.Post("/workflow/{name}/run", handlers.StartWorkflow(database))
+		r.Get("/workflow-run/{id}", handlers.ReadWorkflowRun(database))
 		r.Post("/job/{id}/started", handlers.SetJobState(database, "inprogress"))
 		r.Post("/job/{id}/complete", handlers.SetJobState(database, "complete"))
 		r.Post("/job/{id}/fail", handlers.SetJobState(database, "fail"))
+		r.Post("/job/{id}/reject", handlers.RejectJob(database))
+		r.Post("/job/{id}/cancel", handlers.CancelJob(database))
+		r.Post("/job/{id}/heartbeat", handlers.Heartbeat(database))
+		r.Post("/job/{id}/progress", handlers.ReportProgress(database))
+		r.Post("/job/{id}/log", handlers.AppendJobLog(database))
+		r.Get("/job/{id}/log", handlers.GetJobLog(database))
+		r.Post("/job/{id}/artifact", handlers.UploadArtifacts(database, store))
+		r.Get("/job/{id}/artifact", handlers.ListArtifacts(database))
+		r.Get("/job/{id}/artifact/{name}", handlers.DownloadArtifact(database, store))
+		r.Get("/events", handlers.StreamEvents(database))
 	})
 
 	r.Get("/login", handlers.LoginPage)
@@ -42,6 +66,35 @@ func main() {
 	r.Group(func(r chi.Router) {
 		r.Use(middleware.RequireUserAuth)
 		r.Get("/", handlers.Dashboard(database))
+		r.Get("/events", handlers.StreamEvents(database))
+		r.Get("/job/{id}", handlers.JobPage(database))
+		r.Post("/job/{id}/cancel", handlers.CancelJobForm(database))
+		r.Post("/job/{id}/requeue", handlers.RequeueJobForm(database))
+		r.Post("/job/{id}/clone", handlers.CloneJobForm(database))
+		r.Get("/job/{id}/log", handlers.GetJobLog(database))
+		r.Get("/job/{id}/artifact/{name}", handlers.DownloadArtifact(database, store))
+		r.Get("/batches", handlers.BatchesPage(database))
+		r.Get("/batch/{id}", handlers.BatchPage(database))
+		r.Get("/workflows", handlers.WorkflowsPage(database))
+		r.Post("/workflow", handlers.SaveWorkflowForm(database))
+		r.Post("/workflow/{name}/run", handlers.StartWorkflowForm(database))
+		r.Delete("/workflow/{name}", handlers.DeleteWorkflow(database))
+		r.Get("/workflow-run/{id}", handlers.WorkflowRunPage(database))
+		r.Get("/schedules", handlers.SchedulesPage(database))
+		r.Post("/schedule", handlers.CreateSchedule(database))
+		r.Post("/schedule/{id}/pause", handlers.PauseSchedule(database))
+		r.Post("/schedule/{id}/resume", handlers.ResumeSchedule(database))
+		r.Delete("/schedule/{id}", handlers.DeleteSchedule(database))
+		r.Get("/webhooks", handlers.WebhooksPage(database))
+		r.Post("/webhook", handlers.CreateWebhook(database))
+		r.Get("/webhook/{id}", handlers.WebhookPage(database))
+		r.Post("/webhook/{id}/pause", handlers.PauseWebhook(database, true))
+		r.Post("/webhook/{id}/resume", handlers.PauseWebhook(database, false))
+		r.Delete("/webhook/{id}", handlers.DeleteWebhook(database))
+		r.Post("/webhook/{id}/delivery/{delivery}/redeliver", handlers.RedeliverWebhook(database))
+		r.Get("/deadletter", handlers.DeadLetterPage(database))
+		r.Post("/deadletter/requeue", handlers.RequeueDeadLetters(database))
+		r.Post("/deadletter/discard", handlers.DiscardDeadLetters(database))
 		r.Get("/tokens", handlers.TokensPage(database))
 		r.Post("/token", handlers.CreateToken(database))
 		r.Delete("/token/{id}", handlers.DeleteToken(database))
@@ -52,6 +105,13 @@ func main() {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 	slog.SetDefault(logger)
 
+	go queue.RunReaper(database)
+	go queue.RunRetention(database, store)
+	go queue.RunBatchCallbacks(database)
+	go queue.RunListener(db.NewListener())
+	go scheduler.Run(database)
+	go webhook.Run(database)
+
 	slog.Info("Starting server", "addr", ":3000")
 	err := http.ListenAndServe(":3000", r)
 	if err != nil {
@@ -3,8 +3,9 @@ module github.com/dusansimic/jobledger
 go 1.24.5
 
 require (
-	github.com/go-chi/chi/v5 v5.2.2 // indirect
-	github.com/golang-jwt/jwt/v5 v5.2.3 // indirect
-	github.com/jmoiron/sqlx v1.4.0 // indirect
-	github.com/lib/pq v1.10.9 // indirect
+	github.com/go-chi/chi/v5 v5.2.2
+	github.com/golang-jwt/jwt/v5 v5.2.3
+	github.com/jmoiron/sqlx v1.4.0
+	github.com/lib/pq v1.10.9
+	github.com/robfig/cron/v3 v3.0.1
 )
@@ -0,0 +1,61 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// ErrNotFound is returned when a blob does not exist in the store.
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore keeps the contents of job artifacts. Keys are slash separated
+// paths made of letters, digits, dashes and dots.
+type BlobStore interface {
+	// Put stores size bytes read from r under key, replacing any blob that
+	// is already stored under it.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get opens the blob stored under key. The caller closes the reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the blob stored under key. Deleting a blob that does
+	// not exist is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// Init creates the blob store selected by the BLOB_STORE environment
+// variable, either local (default) or s3.
+func Init() BlobStore {
+	switch kind := os.Getenv("BLOB_STORE"); kind {
+	case "", "local":
+		path := os.Getenv("BLOB_LOCAL_PATH")
+		if path == "" {
+			path = "./artifacts"
+		}
+		store, err := NewLocalStore(path)
+		if err != nil {
+			slog.Error("Could not create local blob store", "path", path, "err", err)
+			os.Exit(1)
+		}
+		return store
+	case "s3":
+		store, err := NewS3Store(S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			VirtualHosted:   os.Getenv("S3_VIRTUAL_HOSTED") == "true",
+		})
+		if err != nil {
+			slog.Error("Could not create s3 blob store", "err", err)
+			os.Exit(1)
+		}
+		return store
+	default:
+		slog.Error("BLOB_STORE must be either local or s3", "value", kind)
+		os.Exit(1)
+		return nil
+	}
+}
@@ -0,0 +1,100 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LocalStore keeps blobs as files below a directory on the local
+// filesystem.
+type LocalStore struct {
+	root string
+}
+
+func NewLocalStore(root string) (*LocalStore, error) {
+	err := os.MkdirAll(root, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	return &LocalStore{root: root}, nil
+}
+
+// path maps a key to a file below the root, refusing keys that would
+// escape it.
+func (s *LocalStore) path(key string) (string, error) {
+	if key == "" || !filepath.IsLocal(filepath.FromSlash(key)) || strings.Contains(key, "\\") {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+func (s *LocalStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create blob directory: %w", err)
+	}
+
+	// write to a temporary file first so readers never see a partial blob
+	file, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create blob file: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	written, err := io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+	if written != size {
+		return fmt.Errorf("failed to write blob: wrote %d of %d bytes", written, size)
+	}
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return fmt.Errorf("failed to move blob into place: %w", err)
+	}
+	return nil
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to open blob: %w", err)
+	}
+	return file, nil
+}
+
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	return nil
+}
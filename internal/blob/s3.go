@@ -0,0 +1,221 @@
+package blob
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config describes the bucket an S3Store keeps its blobs in. Any
+// S3-compatible service works, e.g. MinIO running next to the server.
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. http://localhost:9000.
+	// It defaults to the AWS endpoint of the region.
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// VirtualHosted addresses the bucket as a subdomain of the endpoint
+	// instead of as the first path segment.
+	VirtualHosted bool
+}
+
+// S3Store keeps blobs as objects in an S3 bucket. Requests are signed with
+// AWS Signature Version 4.
+type S3Store struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func NewS3Store(config S3Config) (*S3Store, error) {
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	if config.Bucket == "" {
+		return nil, errors.New("bucket is required")
+	}
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, errors.New("access key id and secret access key are required")
+	}
+
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", config.Endpoint)
+	}
+
+	return &S3Store{
+		config:   config,
+		endpoint: endpoint,
+		client:   &http.Client{},
+	}, nil
+}
+
+// objectURL returns the URL of the object stored under key.
+func (s *S3Store) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	escaped := strings.Join(segments, "/")
+
+	if s.config.VirtualHosted {
+		u.Host = s.config.Bucket + "." + u.Host
+		u.Path = "/" + key
+		u.RawPath = "/" + escaped
+	} else {
+		u.Path = "/" + s.config.Bucket + "/" + key
+		u.RawPath = "/" + url.PathEscape(s.config.Bucket) + "/" + escaped
+	}
+	return &u
+}
+
+func (s *S3Store) do(ctx context.Context, method, key string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	s.sign(req, "UNSIGNED-PAYLOAD", time.Now())
+	return s.client.Do(req)
+}
+
+// sign adds the x-amz-* headers and the Authorization header of Signature
+// Version 4 to the request. Every header already set on the request is
+// signed together with the host.
+func (s *S3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := strings.Builder{}
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretAccessKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// responseError turns an unexpected response into an error carrying the
+// beginning of the body, which holds the S3 error code.
+func responseError(operation string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("failed to %s blob: %s: %s", operation, resp.Status, strings.TrimSpace(string(body)))
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if size == 0 {
+		// a zero ContentLength with a non-nil body means unknown length
+		r = http.NoBody
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, key, r, size)
+	if err != nil {
+		return fmt.Errorf("failed to put blob: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError("put", resp)
+	}
+	return nil
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blob: %w", err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, responseError("get", resp)
+	}
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, 0)
+	if err != nil {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return responseError("delete", resp)
+	}
+	return nil
+}
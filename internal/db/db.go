@@ -3,9 +3,10 @@ package db
 import (
 	"log/slog"
 	"os"
+	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq" // PostgreSQL driver
+	"github.com/lib/pq"
 )
 
 var connStr string
@@ -45,7 +46,242 @@ func Init() *sqlx.DB {
 			metadata JSONB
 		);
 
+		-- columns added after the initial schema
+		ALTER TABLE job ADD COLUMN IF NOT EXISTS claimed_by TEXT NULL;
+		ALTER TABLE job ADD COLUMN IF NOT EXISTS lease_expires_at TIMESTAMP NULL;
+		ALTER TABLE job ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE job ADD COLUMN IF NOT EXISTS max_attempts INTEGER NOT NULL DEFAULT 1;
+		ALTER TABLE job ADD COLUMN IF NOT EXISTS backoff TEXT NOT NULL DEFAULT 'fixed';
+		ALTER TABLE job ADD COLUMN IF NOT EXISTS backoff_delay INTEGER NOT NULL DEFAULT 10;
+		ALTER TABLE job ADD COLUMN IF NOT EXISTS run_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+		ALTER TABLE job ADD COLUMN IF NOT EXISTS last_error TEXT NULL;
+		ALTER TABLE job ADD COLUMN IF NOT EXISTS priority INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE job ADD COLUMN IF NOT EXISTS result JSONB NULL;
+		ALTER TABLE job ADD COLUMN IF NOT EXISTS error JSONB NULL;
+		ALTER TABLE job ADD COLUMN IF NOT EXISTS progress JSONB NULL;
+		ALTER TABLE job ADD COLUMN IF NOT EXISTS unique_key TEXT NULL;
+
+		CREATE TABLE IF NOT EXISTS workflow (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL UNIQUE,
+			definition JSONB NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+
+		-- a run keeps the definition it was started from, so the graph of
+		-- older runs survives changes to the workflow
+		CREATE TABLE IF NOT EXISTS workflow_run (
+			id SERIAL PRIMARY KEY,
+			workflow_id INTEGER NULL REFERENCES workflow(id) ON DELETE SET NULL,
+			workflow_name TEXT NOT NULL,
+			definition JSONB NOT NULL,
+			inputs JSONB NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+
+		ALTER TABLE job ADD COLUMN IF NOT EXISTS workflow_run_id INTEGER NULL REFERENCES workflow_run(id) ON DELETE SET NULL;
+		ALTER TABLE job ADD COLUMN IF NOT EXISTS workflow_node TEXT NULL;
+
+		CREATE TABLE IF NOT EXISTS job_dependency (
+			job_id INTEGER NOT NULL REFERENCES job(id) ON DELETE CASCADE,
+			parent_id INTEGER NOT NULL REFERENCES job(id) ON DELETE CASCADE,
+			on_failure TEXT NOT NULL DEFAULT 'cancel',
+			PRIMARY KEY (job_id, parent_id)
+		);
+
+		CREATE TABLE IF NOT EXISTS batch (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			completed_at TIMESTAMP NULL,
+			callback_job JSONB NULL,
+			callback_job_id INTEGER NULL,
+			callback_url TEXT NULL,
+			callback_state TEXT NULL,
+			callback_attempts INTEGER NOT NULL DEFAULT 0,
+			callback_next_at TIMESTAMP NULL,
+			callback_error TEXT NULL
+		);
+
+		ALTER TABLE batch ADD COLUMN IF NOT EXISTS callback_secret TEXT NULL;
+		ALTER TABLE job ADD COLUMN IF NOT EXISTS batch_id INTEGER NULL REFERENCES batch(id) ON DELETE SET NULL;
+
+		-- a key belongs to one job until it expires, or until the job
+		-- finishes if expires_at is null
+		CREATE TABLE IF NOT EXISTS job_unique_key (
+			key TEXT PRIMARY KEY,
+			job_id INTEGER NOT NULL REFERENCES job(id) ON DELETE CASCADE,
+			expires_at TIMESTAMP NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS job_log (
+			id BIGSERIAL PRIMARY KEY,
+			job_id INTEGER NOT NULL REFERENCES job(id) ON DELETE CASCADE,
+			seq BIGINT NOT NULL,
+			line TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (job_id, seq)
+		);
+
+		-- artifacts outlive their job until the sweeper has deleted the blob,
+		-- so deleting a job only detaches them
+		CREATE TABLE IF NOT EXISTS job_artifact (
+			id SERIAL PRIMARY KEY,
+			job_id INTEGER NULL REFERENCES job(id) ON DELETE SET NULL,
+			name TEXT NOT NULL,
+			size BIGINT NOT NULL,
+			checksum TEXT NOT NULL,
+			content_type TEXT NOT NULL,
+			blob_key TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS schedule (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL,
+			type TEXT NOT NULL,
+			cron TEXT NOT NULL,
+			timezone TEXT NOT NULL DEFAULT 'UTC',
+			metadata JSONB,
+			paused BOOLEAN NOT NULL DEFAULT FALSE,
+			next_run_at TIMESTAMPTZ NOT NULL,
+			last_run_at TIMESTAMPTZ NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+
+		-- permanently failed jobs used to end up in the fail state. They are
+		-- moved to deadletter once, when the check on the states is added,
+		-- the lock keeps replicas starting at the same time from both
+		-- adding it.
+		DO $$
+		BEGIN
+			PERFORM pg_advisory_xact_lock(hashtext('jobledger_job_state_check'));
+			IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = 'job'::regclass AND conname = 'job_state_check') THEN
+				UPDATE job SET state = 'deadletter' WHERE state = 'fail';
+				ALTER TABLE job ADD CONSTRAINT job_state_check CHECK (
+					state IN ('waiting', 'notstarted', 'inprogress', 'complete', 'cancelled', 'deadletter')
+				);
+			END IF;
+		END $$;
+
+		CREATE TABLE IF NOT EXISTS job_attempt (
+			id SERIAL PRIMARY KEY,
+			job_id INTEGER NOT NULL REFERENCES job(id) ON DELETE CASCADE,
+			attempt INTEGER NOT NULL,
+			claimed_by TEXT NULL,
+			state TEXT NOT NULL DEFAULT 'inprogress',
+			reason TEXT NULL,
+			started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			finished_at TIMESTAMP NULL,
+			UNIQUE (job_id, attempt)
+		);
+
+		-- every job creation and state change, written by a trigger so that
+		-- no code path can miss one. txid orders events by the transaction
+		-- that wrote them, see queue.ReadEvents.
+		CREATE TABLE IF NOT EXISTS job_event (
+			id BIGSERIAL PRIMARY KEY,
+			job_id INTEGER NOT NULL REFERENCES job(id) ON DELETE CASCADE,
+			event TEXT NOT NULL,
+			job_name TEXT NOT NULL,
+			job_type TEXT NOT NULL,
+			state TEXT NOT NULL,
+			previous_state TEXT NULL,
+			txid XID8 NOT NULL DEFAULT pg_current_xact_id(),
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+
+		ALTER TABLE job_event ADD COLUMN IF NOT EXISTS progress JSONB NULL;
+
+		CREATE OR REPLACE FUNCTION record_job_event() RETURNS TRIGGER AS $$
+		BEGIN
+			IF TG_OP = 'INSERT' THEN
+				INSERT INTO job_event (job_id, event, job_name, job_type, state)
+				VALUES (NEW.id, 'created', NEW.name, NEW.type, NEW.state);
+			ELSIF NEW.state IS DISTINCT FROM OLD.state THEN
+				INSERT INTO job_event (job_id, event, job_name, job_type, state, previous_state)
+				VALUES (NEW.id, 'state_changed', NEW.name, NEW.type, NEW.state, OLD.state);
+			-- progress is reported often, it only becomes an event when it
+			-- reaches another whole percent or step
+			ELSIF NEW.progress IS NOT NULL AND (
+				floor((NEW.progress->>'percent')::numeric) IS DISTINCT FROM floor((OLD.progress->>'percent')::numeric)
+				OR NEW.progress->>'step' IS DISTINCT FROM OLD.progress->>'step'
+			) THEN
+				INSERT INTO job_event (job_id, event, job_name, job_type, state, progress)
+				VALUES (NEW.id, 'progress', NEW.name, NEW.type, NEW.state, NEW.progress);
+			ELSE
+				RETURN NULL;
+			END IF;
+			PERFORM pg_notify('jobledger_events', '');
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+
+		DROP TRIGGER IF EXISTS job_event_trigger ON job;
+		CREATE TRIGGER job_event_trigger AFTER INSERT OR UPDATE OF state, progress ON job
+			FOR EACH ROW EXECUTE FUNCTION record_job_event();
+
+		CREATE TABLE IF NOT EXISTS webhook (
+			id SERIAL PRIMARY KEY,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			types TEXT[] NOT NULL DEFAULT '{}',
+			states TEXT[] NOT NULL DEFAULT '{}',
+			paused BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+
+		-- how far the webhook dispatcher has read the event log, the single
+		-- row also serves as its lock
+		CREATE TABLE IF NOT EXISTS webhook_cursor (
+			id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+			txid XID8 NOT NULL,
+			event_id BIGINT NOT NULL
+		);
+
+		-- deliveries keep their payload, the event may be gone by the time
+		-- the last retry is sent
+		CREATE TABLE IF NOT EXISTS webhook_delivery (
+			id BIGSERIAL PRIMARY KEY,
+			webhook_id INTEGER NOT NULL REFERENCES webhook(id) ON DELETE CASCADE,
+			event_id BIGINT NOT NULL,
+			event TEXT NOT NULL,
+			payload JSONB NOT NULL,
+			state TEXT NOT NULL DEFAULT 'pending',
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at TIMESTAMP NULL DEFAULT CURRENT_TIMESTAMP,
+			last_error TEXT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS webhook_attempt (
+			id BIGSERIAL PRIMARY KEY,
+			delivery_id BIGINT NOT NULL REFERENCES webhook_delivery(id) ON DELETE CASCADE,
+			attempt INTEGER NOT NULL,
+			status_code INTEGER NULL,
+			error TEXT NULL,
+			duration_ms INTEGER NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+
 		CREATE INDEX IF NOT EXISTS idx_job_state ON job(state);
+		CREATE INDEX IF NOT EXISTS idx_job_claim ON job(priority DESC, id ASC) WHERE state = 'notstarted';
+		CREATE INDEX IF NOT EXISTS idx_job_run_at ON job(run_at) WHERE state = 'notstarted';
+		CREATE INDEX IF NOT EXISTS idx_job_lease ON job(lease_expires_at) WHERE state = 'inprogress';
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_job_artifact_name ON job_artifact(job_id, name);
+		CREATE INDEX IF NOT EXISTS idx_job_artifact_orphan ON job_artifact(id) WHERE job_id IS NULL;
+		CREATE INDEX IF NOT EXISTS idx_job_dependency_parent ON job_dependency(parent_id);
+		CREATE INDEX IF NOT EXISTS idx_job_workflow_run ON job(workflow_run_id) WHERE workflow_run_id IS NOT NULL;
+		CREATE INDEX IF NOT EXISTS idx_job_batch ON job(batch_id) WHERE batch_id IS NOT NULL;
+		CREATE INDEX IF NOT EXISTS idx_batch_callback ON batch(callback_next_at) WHERE callback_state = 'pending';
+		CREATE INDEX IF NOT EXISTS idx_job_event_cursor ON job_event(txid, id);
+		CREATE INDEX IF NOT EXISTS idx_job_event_job ON job_event(job_id);
+		CREATE INDEX IF NOT EXISTS idx_job_event_created ON job_event(created_at);
+		CREATE INDEX IF NOT EXISTS idx_webhook_delivery_due ON webhook_delivery(next_attempt_at) WHERE state = 'pending';
+		CREATE INDEX IF NOT EXISTS idx_webhook_delivery_webhook ON webhook_delivery(webhook_id, id);
+		CREATE INDEX IF NOT EXISTS idx_webhook_delivery_created ON webhook_delivery(created_at);
+		CREATE INDEX IF NOT EXISTS idx_webhook_attempt_delivery ON webhook_attempt(delivery_id);
 		CREATE INDEX IF NOT EXISTS idx_token_token ON token(token);
 	`
 
@@ -53,3 +289,13 @@ func Init() *sqlx.DB {
 
 	return db
 }
+
+// NewListener opens a dedicated connection for Postgres notifications. It
+// reconnects on its own when the connection drops.
+func NewListener() *pq.Listener {
+	return pq.NewListener(connStr, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			slog.Error("Notification listener failed", "event", event, "err", err)
+		}
+	})
+}
@@ -1,30 +1,133 @@
 package handlers
 
 import (
-	"database/sql"
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"mime"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/dusansimic/jobledger/internal/middleware"
 	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/dusansimic/jobledger/internal/queue"
 	"github.com/go-chi/chi/v5"
 	"github.com/jmoiron/sqlx"
 )
 
+// parseClaimFilter reads the job types and metadata labels a worker is able
+// to handle from the query string. Both type and label may be repeated or
+// hold comma separated values, e.g. ?type=docker.*,terraform.apply&label=arch=arm64.
+func parseClaimFilter(r *http.Request) (queue.Filter, error) {
+	filter := queue.Filter{}
+	query := r.URL.Query()
+
+	for _, param := range query["type"] {
+		for _, t := range strings.Split(param, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				filter.Types = append(filter.Types, t)
+			}
+		}
+	}
+
+	for _, param := range query["label"] {
+		for _, label := range strings.Split(param, ",") {
+			if label = strings.TrimSpace(label); label == "" {
+				continue
+			}
+			key, value, ok := strings.Cut(label, "=")
+			if !ok || key == "" {
+				return filter, fmt.Errorf("invalid label %q, expected key=value", label)
+			}
+			if filter.Labels == nil {
+				filter.Labels = map[string]string{}
+			}
+			filter.Labels[key] = value
+		}
+	}
+
+	return filter, nil
+}
+
+// parseLease reads the requested lease duration from the lease query
+// parameter, falling back to the server default. Leases longer than
+// queue.MaxLeaseDuration are rejected so the reaper can still recover jobs
+// of workers that died.
+func parseLease(r *http.Request) (time.Duration, error) {
+	param := r.URL.Query().Get("lease")
+	if param == "" {
+		return queue.LeaseDuration, nil
+	}
+
+	lease, err := time.ParseDuration(param)
+	if err != nil || lease <= 0 {
+		return 0, fmt.Errorf("invalid lease %q, expected a positive duration such as 5m", param)
+	}
+	if lease > queue.MaxLeaseDuration {
+		return 0, fmt.Errorf("lease %q is longer than the maximum of %s", param, queue.MaxLeaseDuration)
+	}
+	return lease, nil
+}
+
+// parseWait returns how long a claim may wait for a job, given in seconds
+// by the wait query parameter. Without it the claim returns right away.
+func parseWait(r *http.Request) (time.Duration, error) {
+	param := r.URL.Query().Get("wait")
+	if param == "" {
+		return 0, nil
+	}
+
+	seconds, err := strconv.Atoi(param)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid wait %q, expected a number of seconds", param)
+	}
+	return min(time.Duration(seconds)*time.Second, queue.MaxClaimWait), nil
+}
+
+// GetJob claims the next job for the calling worker. The job is moved to
+// inprogress before it is returned, so it is never handed out twice. With
+// ?wait=N the request blocks for up to N seconds until a matching job is
+// enqueued.
 func GetJob(db *sqlx.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		job := []models.Job{}
+		filter, err := parseClaimFilter(r)
+		if err != nil {
+			slog.Info("Failed to parse claim filter", "handler", "GetJob", "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		err := db.Select(&job, "SELECT * FROM job WHERE state = 'notstarted' ORDER BY id ASC LIMIT 1")
+		lease, err := parseLease(r)
+		if err != nil {
+			slog.Info("Failed to parse lease", "handler", "GetJob", "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		wait, err := parseWait(r)
+		if err != nil {
+			slog.Info("Failed to parse wait", "handler", "GetJob", "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		job, err := queue.ClaimWait(r.Context(), db, filter, middleware.AppID(r), lease, wait)
 		if err != nil {
 			// if no new job is found, return 204 No Content
-			if err == sql.ErrNoRows {
+			if errors.Is(err, queue.ErrNoJob) {
 				w.WriteHeader(http.StatusNoContent)
 				return
 			}
 
 			// if there is an error, log it and return 500 Internal Server Error
-			slog.Error("Failed to query job", "handler", "GetJob", "err", err)
+			slog.Error("Failed to claim job", "handler", "GetJob", "err", err)
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusInternalServerError)
 			json.NewEncoder(w).Encode(map[string]string{
@@ -33,79 +136,470 @@ func GetJob(db *sqlx.DB) http.HandlerFunc {
 			return
 		}
 
-		if len(job) == 0 {
-			// if no job is found, return 204 No Content
-			w.WriteHeader(http.StatusNoContent)
+		// if a job is claimed, return it as JSON
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(job)
+	}
+}
+
+// CreateJob enqueues a job and responds with 201 Created, the job and its
+// location.
+func CreateJob(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job := queue.NewJob{}
+
+		err := json.NewDecoder(r.Body).Decode(&job)
+		if err != nil {
+			slog.Info("Failed to parse json", "handler", "CreateJob", "err", err)
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+
+		// the header and the field are interchangeable, but must agree
+		if key := r.Header.Get("Idempotency-Key"); key != "" {
+			if job.UniqueKey != "" && job.UniqueKey != key {
+				http.Error(w, "Idempotency-Key header and unique_key differ", http.StatusBadRequest)
+				return
+			}
+			job.UniqueKey = key
+		}
+
+		enqueued, created, err := queue.Enqueue(db, job)
+		if err != nil {
+			if errors.Is(err, queue.ErrInvalidJob) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			slog.Error("Failed to enqueue job", "handler", "CreateJob", "err", err)
+			http.Error(w, "failed to run query", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Location", fmt.Sprintf("/api/job/%d", enqueued.ID))
+
+		// a repeated request gets the job created by the first one
+		if !created {
+			writeJob(w, enqueued)
 			return
 		}
 
-		// if a job is found, return it as JSON
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(job[0])
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(enqueued)
 	}
 }
 
-func CreateJob(db *sqlx.DB) http.HandlerFunc {
-	type JobPayload struct {
-		Name     string             `json:"name"`
-		Type     string             `json:"type"`
-		Metadata models.MetadataMap `json:"metadata"`
+const (
+	// maxBulkJobs is the largest number of jobs accepted by a bulk request
+	maxBulkJobs = 10000
+	// maxBulkLineBytes is the longest NDJSON line of a bulk request
+	maxBulkLineBytes = 1 << 20
+)
+
+// decodeBulkJobs reads the jobs of a bulk request, either a JSON array or,
+// with the application/x-ndjson content type, one job per line. Jobs that
+// can't be decoded get an error at their index instead.
+func decodeBulkJobs(r *http.Request) ([]queue.NewJob, map[int]string, error) {
+	raw := []json.RawMessage{}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-ndjson" || mediaType == "application/jsonl" {
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxBulkLineBytes)
+		for scanner.Scan() {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			raw = append(raw, json.RawMessage(slices.Clone(scanner.Bytes())))
+			if len(raw) > maxBulkJobs {
+				break
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		err := json.NewDecoder(r.Body).Decode(&raw)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(raw) > maxBulkJobs {
+		return nil, nil, fmt.Errorf("at most %d jobs can be enqueued at once", maxBulkJobs)
+	}
+
+	jobs := make([]queue.NewJob, len(raw))
+	invalid := map[int]string{}
+	for i, item := range raw {
+		err := json.Unmarshal(item, &jobs[i])
+		if err != nil {
+			invalid[i] = "invalid json"
+		}
 	}
+	return jobs, invalid, nil
+}
 
+// CreateJobs enqueues many jobs in one transaction. By default the request
+// is all-or-nothing, with ?mode=best_effort invalid jobs are skipped and
+// the rest is enqueued. The response holds the id or the error of every
+// job in request order.
+func CreateJobs(db *sqlx.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		job := JobPayload{}
+		atomic := true
+		switch mode := r.URL.Query().Get("mode"); mode {
+		case "", "atomic":
+		case "best_effort":
+			atomic = false
+		default:
+			http.Error(w, "mode must be either atomic or best_effort", http.StatusBadRequest)
+			return
+		}
 
-		err := json.NewDecoder(r.Body).Decode(&job)
+		jobs, invalid, err := decodeBulkJobs(r)
 		if err != nil {
-			slog.Info("Failed to parse json", "handler", "CreateJob", "err", err)
+			slog.Info("Failed to parse jobs", "handler", "CreateJobs", "err", err)
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// jobs that could not be decoded are left out of the insert and
+		// their results are filled in afterwards
+		valid := make([]queue.NewJob, 0, len(jobs))
+		indexes := make([]int, 0, len(jobs))
+		for i, job := range jobs {
+			if _, ok := invalid[i]; !ok {
+				valid = append(valid, job)
+				indexes = append(indexes, i)
+			}
+		}
+
+		var enqueued []queue.BulkResult
+		if len(invalid) == 0 || !atomic {
+			enqueued, err = queue.EnqueueBulk(db, valid, atomic)
+			if err != nil && !errors.Is(err, queue.ErrInvalidJob) {
+				slog.Error("Failed to enqueue jobs", "handler", "CreateJobs", "err", err)
+				http.Error(w, "failed to run query", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		results := make([]queue.BulkResult, len(jobs))
+		for i := range results {
+			results[i] = queue.BulkResult{Index: i, Error: invalid[i]}
+		}
+		for k, result := range enqueued {
+			result.Index = indexes[k]
+			results[indexes[k]] = result
+		}
+
+		status := http.StatusOK
+		if atomic && (len(invalid) > 0 || errors.Is(err, queue.ErrInvalidJob)) {
+			status = http.StatusBadRequest
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string][]queue.BulkResult{
+			"jobs": results,
+		})
+	}
+}
+
+// CreateBatch creates a batch together with its jobs, e.g.
+// {"name": "matrix", "jobs": [...], "callback": {"url": "https://..."}}.
+// The mode query parameter works like it does for CreateJobs.
+func CreateBatch(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic := true
+		switch mode := r.URL.Query().Get("mode"); mode {
+		case "", "atomic":
+		case "best_effort":
+			atomic = false
+		default:
+			http.Error(w, "mode must be either atomic or best_effort", http.StatusBadRequest)
+			return
+		}
+
+		batch := queue.NewBatch{}
+		err := json.NewDecoder(r.Body).Decode(&batch)
+		if err != nil {
+			slog.Info("Failed to parse json", "handler", "CreateBatch", "err", err)
 			http.Error(w, "invalid json", http.StatusBadRequest)
 			return
 		}
+		if len(batch.Jobs) > maxBulkJobs {
+			http.Error(w, fmt.Sprintf("at most %d jobs can be enqueued at once", maxBulkJobs), http.StatusBadRequest)
+			return
+		}
 
-		query := `
-			INSERT INTO job (name, type, state, created_at, started_at, completed_at, metadata)
-			VALUES (:name, :type, 'notstarted', CURRENT_TIMESTAMP, NULL, NULL, :metadata);
-		`
+		created, results, err := queue.CreateBatch(db, batch, atomic)
+		if err != nil {
+			if !errors.Is(err, queue.ErrInvalidJob) && !errors.Is(err, queue.ErrInvalidBatch) {
+				slog.Error("Failed to create batch", "handler", "CreateBatch", "err", err)
+				http.Error(w, "failed to run query", http.StatusInternalServerError)
+				return
+			}
+			if results == nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]any{
+				"jobs": results,
+			})
+			return
+		}
 
-		_, err = db.NamedExec(query, &job)
+		summary, err := queue.GetBatch(db, strconv.Itoa(created.ID))
 		if err != nil {
-			slog.Error("Failed to run named query", "handler", "CreateJob", "err", err)
+			slog.Error("Failed to query batch", "handler", "CreateBatch", "err", err)
 			http.Error(w, "failed to run query", http.StatusInternalServerError)
 			return
 		}
 
+		response := map[string]any{
+			"batch": summary,
+			"jobs":  results,
+		}
+		// the secret is only ever handed out here
+		if created.CallbackSecret != nil {
+			response["callback_secret"] = *created.CallbackSecret
+		}
+
+		w.Header().Set("Location", fmt.Sprintf("/api/batch/%d", created.ID))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// ReadBatch returns a batch with the number of its jobs in each state.
+func ReadBatch(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		summary, err := queue.GetBatch(db, id)
+		if err != nil {
+			writeJobError(w, "ReadBatch", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(summary)
+	}
+}
+
+// ReadJob returns a single job by its id.
+func ReadJob(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		job, err := queue.Get(db, id)
+		if err != nil {
+			writeJobError(w, "ReadJob", err)
+			return
+		}
+
+		writeJob(w, job)
+	}
+}
+
+// writeJob responds with the job as JSON.
+func writeJob(w http.ResponseWriter, job *models.Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(job)
+}
+
+// writeJobError responds to a failed operation on a single job.
+func writeJobError(w http.ResponseWriter, handler string, err error) {
+	status, message := jobErrorStatus(handler, err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": message,
+	})
+}
+
+// jobErrorStatus returns the status code and message of a failed operation
+// on a single job. Errors the worker can act on get their own status code,
+// anything else is logged and reported as an internal error.
+func jobErrorStatus(handler string, err error) (int, string) {
+	status := http.StatusInternalServerError
+	message := "failed to update job"
+
+	switch {
+	case errors.Is(err, queue.ErrJobNotFound):
+		status = http.StatusNotFound
+		message = "job not found"
+	case errors.Is(err, queue.ErrBatchNotFound):
+		status = http.StatusNotFound
+		message = "batch not found"
+	case errors.Is(err, queue.ErrArtifactNotFound):
+		status = http.StatusNotFound
+		message = "artifact not found"
+	case errors.Is(err, queue.ErrJobCancelled):
+		status = http.StatusConflict
+		message = "job cancelled"
+	case errors.Is(err, queue.ErrInvalidState):
+		status = http.StatusConflict
+		message = err.Error()
+	default:
+		slog.Error("Failed to update job", "handler", handler, "err", err)
+	}
+	return status, message
+}
+
+// JobStatePayload is the optional body of a state update. Workers attach
+// the result of a completed job, which may be any JSON value, or the error
+// of a failed one.
+type JobStatePayload struct {
+	Result models.JSONValue `json:"result"`
+	Error  *models.JobError `json:"error"`
+}
+
+// decodeStatePayload reads the body of a state update, an empty body is
+// allowed. If the payload carries no error message, fallback is used.
+func decodeStatePayload(r *http.Request, fallback string) (JobStatePayload, error) {
+	payload := JobStatePayload{}
+
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return payload, err
+	}
+
+	if payload.Error == nil {
+		payload.Error = &models.JobError{}
 	}
+	if payload.Error.Message == "" {
+		payload.Error.Message = fallback
+	}
+	return payload, nil
 }
 
 func SetJobState(db *sqlx.DB, state string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := chi.URLParam(r, "id")
 
-		var query string
+		payload, err := decodeStatePayload(r, "failed by worker")
+		if err != nil {
+			slog.Info("Failed to parse json", "handler", "SetJobState", "err", err)
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+
+		var job *models.Job
 
-		if state == "inprogress" {
-			query = `
-				UPDATE job
-				SET state = $1, started_at = CURRENT_TIMESTAMP
-				WHERE id = $2;
-			`
-		} else {
-			query = `
-				UPDATE job
-				SET state = $1, completed_at = CURRENT_TIMESTAMP
-				WHERE id = $2;
-			`
+		switch state {
+		case "inprogress":
+			job, err = queue.Start(db, id, middleware.AppID(r))
+		case "complete":
+			job, err = queue.Complete(db, id, middleware.AppID(r), payload.Result)
+		case "fail":
+			job, err = queue.Fail(db, id, middleware.AppID(r), *payload.Error)
 		}
 
-		_, err := db.Exec(query, state, id)
 		if err != nil {
-			slog.Error("Failed to update job state", "handler", "SetJobState", "err", err)
-			http.Error(w, "failed to update job state", http.StatusInternalServerError)
+			writeJobError(w, "SetJobState", err)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		writeJob(w, job)
+	}
+}
+
+// RejectJob dead-letters a job that its worker can never complete, skipping
+// any attempts it has left.
+func RejectJob(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		payload, err := decodeStatePayload(r, "rejected by worker")
+		if err != nil {
+			slog.Info("Failed to parse json", "handler", "RejectJob", "err", err)
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+
+		job, err := queue.Reject(db, id, middleware.AppID(r), *payload.Error)
+		if err != nil {
+			writeJobError(w, "RejectJob", err)
+			return
+		}
+
+		writeJob(w, job)
+	}
+}
+
+// CancelJob cancels a job that has not finished yet.
+func CancelJob(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		job, err := queue.Cancel(db, id)
+		if err != nil {
+			writeJobError(w, "CancelJob", err)
+			return
+		}
+
+		writeJob(w, job)
+	}
+}
+
+// ReportProgress stores the latest progress of an in-progress job, e.g.
+// {"percent": 42.5, "step": "migrating users", "counters": {"rows": 1200}}.
+func ReportProgress(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		progress := models.JobProgress{}
+		err := json.NewDecoder(r.Body).Decode(&progress)
+		if err != nil {
+			slog.Info("Failed to parse json", "handler", "ReportProgress", "err", err)
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		if progress.Percent < 0 || progress.Percent > 100 {
+			http.Error(w, "percent must be between 0 and 100", http.StatusBadRequest)
+			return
+		}
+
+		job, err := queue.ReportProgress(db, id, middleware.AppID(r), progress)
+		if err != nil {
+			writeJobError(w, "ReportProgress", err)
+			return
+		}
+
+		writeJob(w, job)
+	}
+}
+
+// Heartbeat extends the lease of an in-progress job. Workers must call it
+// before the lease runs out, otherwise the reaper reclaims the job. A 409
+// response tells the worker the job was cancelled and it should abort.
+func Heartbeat(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		lease, err := parseLease(r)
+		if err != nil {
+			slog.Info("Failed to parse lease", "handler", "Heartbeat", "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		job, err := queue.Heartbeat(db, id, middleware.AppID(r), lease)
+		if err != nil {
+			writeJobError(w, "Heartbeat", err)
+			return
+		}
+
+		writeJob(w, job)
 	}
 }
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/dusansimic/jobledger/internal/blob"
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/dusansimic/jobledger/internal/queue"
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// ArtifactMaxBytes is the largest artifact upload accepted in one request.
+var ArtifactMaxBytes int64 = 1 << 30
+
+func init() {
+	if value := os.Getenv("ARTIFACT_MAX_BYTES"); value != "" {
+		maxBytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxBytes <= 0 {
+			slog.Error("ARTIFACT_MAX_BYTES is not a valid size", "value", value)
+			os.Exit(1)
+		}
+		ArtifactMaxBytes = maxBytes
+	}
+}
+
+// newBlobKey returns a random key for the blob of a new artifact. Keys are
+// never reused, so replacing an artifact doesn't overwrite a blob that is
+// still being downloaded.
+func newBlobKey() string {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	return "artifacts/" + hex.EncodeToString(bytes)
+}
+
+// storeArtifact copies an uploaded file into the blob store. The file is
+// spooled to disk first to compute its size and checksum, which the S3
+// backend needs before the upload starts.
+func storeArtifact(ctx context.Context, store blob.BlobStore, name string, contentType string, r io.Reader) (models.JobArtifact, error) {
+	artifact := models.JobArtifact{
+		Name:        name,
+		ContentType: contentType,
+		BlobKey:     newBlobKey(),
+	}
+
+	file, err := os.CreateTemp("", "jobledger-artifact-*")
+	if err != nil {
+		return artifact, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	hash := sha256.New()
+	artifact.Size, err = io.Copy(io.MultiWriter(file, hash), r)
+	if err != nil {
+		return artifact, err
+	}
+	artifact.Checksum = hex.EncodeToString(hash.Sum(nil))
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return artifact, err
+	}
+	return artifact, store.Put(ctx, artifact.BlobKey, file, artifact.Size)
+}
+
+// UploadArtifacts attaches the files of a multipart/form-data upload to an
+// in-progress job, each file becomes an artifact named after its file name.
+// Uploading a file with the name of an existing artifact replaces it.
+func UploadArtifacts(db *sqlx.DB, store blob.BlobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		r.Body = http.MaxBytesReader(w, r.Body, ArtifactMaxBytes)
+
+		reader, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, "expected a multipart/form-data upload", http.StatusBadRequest)
+			return
+		}
+
+		artifacts := []models.JobArtifact{}
+		for {
+			part, err := reader.NextPart()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				if tooLarge(w, err) {
+					return
+				}
+				slog.Info("Failed to read multipart upload", "handler", "UploadArtifacts", "err", err)
+				http.Error(w, "failed to read multipart upload", http.StatusBadRequest)
+				return
+			}
+
+			// form fields without a file name are not artifacts
+			name := part.FileName()
+			if name == "" || name == "." {
+				part.Close()
+				continue
+			}
+
+			contentType := part.Header.Get("Content-Type")
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+
+			artifact, err := storeArtifact(r.Context(), store, name, contentType, part)
+			part.Close()
+			if err != nil {
+				if tooLarge(w, err) {
+					return
+				}
+				slog.Error("Failed to store artifact", "handler", "UploadArtifacts", "name", name, "err", err)
+				http.Error(w, "failed to store artifact", http.StatusInternalServerError)
+				return
+			}
+
+			added, err := queue.AddArtifact(db, id, artifact)
+			if err != nil {
+				// the blob was never recorded, so the sweeper can't find it
+				deleteErr := store.Delete(context.Background(), artifact.BlobKey)
+				if deleteErr != nil {
+					slog.Error("Failed to delete artifact blob", "handler", "UploadArtifacts", "key", artifact.BlobKey, "err", deleteErr)
+				}
+				writeJobError(w, "UploadArtifacts", err)
+				return
+			}
+			artifacts = append(artifacts, *added)
+		}
+
+		if len(artifacts) == 0 {
+			http.Error(w, "upload contains no files", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(artifacts)
+	}
+}
+
+// tooLarge answers with 413 if err is caused by an upload exceeding
+// ArtifactMaxBytes and reports whether it did.
+func tooLarge(w http.ResponseWriter, err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(err, &maxBytesErr) {
+		return false
+	}
+	http.Error(w, "upload exceeds "+strconv.FormatInt(maxBytesErr.Limit, 10)+" bytes", http.StatusRequestEntityTooLarge)
+	return true
+}
+
+// ListArtifacts returns the artifacts of a job as JSON.
+func ListArtifacts(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		artifacts, err := queue.ListArtifacts(db, id)
+		if err != nil {
+			writeJobError(w, "ListArtifacts", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(artifacts)
+	}
+}
+
+// DownloadArtifact sends the contents of an artifact as an attachment. The
+// checksum is sent in the ETag header.
+func DownloadArtifact(db *sqlx.DB, store blob.BlobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		name := chi.URLParam(r, "name")
+		// chi matches against the escaped path if it differs from the default
+		// encoding, in which case the name is still escaped
+		if r.URL.RawPath != "" {
+			unescaped, err := url.PathUnescape(name)
+			if err == nil {
+				name = unescaped
+			}
+		}
+
+		artifact, err := queue.GetArtifact(db, id, name)
+		if err != nil {
+			writeJobError(w, "DownloadArtifact", err)
+			return
+		}
+
+		contents, err := store.Get(r.Context(), artifact.BlobKey)
+		if err != nil {
+			if errors.Is(err, blob.ErrNotFound) {
+				slog.Error("Artifact blob is missing", "handler", "DownloadArtifact", "key", artifact.BlobKey)
+				http.Error(w, "artifact contents are missing", http.StatusNotFound)
+				return
+			}
+			slog.Error("Failed to get artifact blob", "handler", "DownloadArtifact", "key", artifact.BlobKey, "err", err)
+			http.Error(w, "failed to get artifact", http.StatusInternalServerError)
+			return
+		}
+		defer contents.Close()
+
+		w.Header().Set("Content-Type", artifact.ContentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(artifact.Size, 10))
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": artifact.Name}))
+		w.Header().Set("ETag", `"`+artifact.Checksum+`"`)
+		w.WriteHeader(http.StatusOK)
+		io.Copy(w, contents)
+	}
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/dusansimic/jobledger/internal/queue"
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+type BatchData struct {
+	models.BatchSummary
+	// Percent is the share of jobs that have finished
+	Percent float64
+	// CallbackDelivery is the delivery state of the callback webhook
+	CallbackDelivery string
+}
+
+func newBatchData(summary models.BatchSummary) BatchData {
+	data := BatchData{BatchSummary: summary}
+	if summary.CallbackState != nil {
+		data.CallbackDelivery = *summary.CallbackState
+	}
+	if summary.Total > 0 {
+		finished := summary.Complete + summary.Failed + summary.Cancelled
+		data.Percent = float64(finished) * 100 / float64(summary.Total)
+	}
+	return data
+}
+
+type BatchesPageData struct {
+	Batches    []BatchData
+	Pagination PaginationData
+}
+
+func BatchesPage(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page := parsePage(r)
+		pageSize := 15
+		offset := (page - 1) * pageSize
+
+		var totalBatches int
+		err := db.Get(&totalBatches, "SELECT COUNT(*) FROM batch")
+		if err != nil {
+			slog.Error("Failed to count batches", "handler", "BatchesPage", "err", err)
+			http.Error(w, "failed to count batches", http.StatusInternalServerError)
+			return
+		}
+
+		summaries, err := queue.ListBatches(db, pageSize, offset)
+		if err != nil {
+			slog.Error("Failed to query batches", "handler", "BatchesPage", "err", err)
+			http.Error(w, "failed to query batches", http.StatusInternalServerError)
+			return
+		}
+
+		batches := make([]BatchData, len(summaries))
+		for i, summary := range summaries {
+			batches[i] = newBatchData(summary)
+		}
+
+		templates.ExecuteTemplate(w, "batches.html", BatchesPageData{
+			Batches: batches,
+			Pagination: PaginationData{
+				Page:       page,
+				PageSize:   pageSize,
+				TotalPages: (totalBatches + pageSize - 1) / pageSize,
+			},
+		})
+	}
+}
+
+type BatchPageData struct {
+	Batch BatchData
+	Jobs  []JobData
+}
+
+func BatchPage(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		batchID := chi.URLParam(r, "id")
+
+		summary, err := queue.GetBatch(db, batchID)
+		if err != nil {
+			if errors.Is(err, queue.ErrBatchNotFound) {
+				http.Error(w, "batch not found", http.StatusNotFound)
+				return
+			}
+			slog.Error("Failed to query batch", "handler", "BatchPage", "id", batchID, "err", err)
+			http.Error(w, "failed to query batch", http.StatusInternalServerError)
+			return
+		}
+
+		jobs := []models.Job{}
+		err = db.Select(&jobs, "SELECT * FROM job WHERE batch_id = $1 ORDER BY id ASC", summary.ID)
+		if err != nil {
+			slog.Error("Failed to query batch jobs", "handler", "BatchPage", "id", batchID, "err", err)
+			http.Error(w, "failed to query batch jobs", http.StatusInternalServerError)
+			return
+		}
+
+		jobsData := make([]JobData, len(jobs))
+		for i, job := range jobs {
+			jobsData[i] = newJobData(job)
+		}
+
+		templates.ExecuteTemplate(w, "batch.html", BatchPageData{
+			Batch: newBatchData(*summary),
+			Jobs:  jobsData,
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/dusansimic/jobledger/internal/queue"
+	"github.com/jmoiron/sqlx"
+)
+
+type DeadLetterData struct {
+	ID          int
+	Name        string
+	Type        string
+	Attempts    int
+	MaxAttempts int
+	LastError   string
+	FailedAt    *time.Time
+}
+
+type DeadLetterPageData struct {
+	Message    Message
+	Jobs       []DeadLetterData
+	Pagination PaginationData
+}
+
+func renderDeadLetterPage(w http.ResponseWriter, r *http.Request, db *sqlx.DB, message Message) {
+	page := parsePage(r)
+	pageSize := 15
+	offset := (page - 1) * pageSize
+
+	var totalJobs int
+	err := db.Get(&totalJobs, "SELECT COUNT(*) FROM job WHERE state = 'deadletter'")
+	if err != nil {
+		slog.Error("Failed to count dead-lettered jobs", "handler", "DeadLetterPage", "err", err)
+		http.Error(w, "failed to count jobs", http.StatusInternalServerError)
+		return
+	}
+
+	jobs := []models.Job{}
+	err = db.Select(&jobs, `
+		SELECT * FROM job
+		WHERE state = 'deadletter'
+		ORDER BY completed_at DESC, id DESC
+		LIMIT $1 OFFSET $2
+	`, pageSize, offset)
+	if err != nil {
+		slog.Error("Failed to query dead-lettered jobs", "handler", "DeadLetterPage", "err", err)
+		http.Error(w, "failed to query jobs", http.StatusInternalServerError)
+		return
+	}
+
+	jobsData := make([]DeadLetterData, len(jobs))
+	for i, job := range jobs {
+		jobsData[i] = DeadLetterData{
+			ID:          job.ID,
+			Name:        job.Name,
+			Type:        job.Type,
+			Attempts:    job.Attempts,
+			MaxAttempts: job.MaxAttempts,
+			FailedAt:    job.CompletedAt,
+		}
+		if job.LastError != nil {
+			jobsData[i].LastError = *job.LastError
+		}
+	}
+
+	templates.ExecuteTemplate(w, "deadletter.html", DeadLetterPageData{
+		Message: message,
+		Jobs:    jobsData,
+		Pagination: PaginationData{
+			Page:       page,
+			PageSize:   pageSize,
+			TotalPages: (totalJobs + pageSize - 1) / pageSize,
+		},
+	})
+}
+
+func DeadLetterPage(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderDeadLetterPage(w, r, db, Message{
+			IsError:   false,
+			IsSuccess: false,
+		})
+	}
+}
+
+// parseJobIDs reads the ids of the jobs selected in a form.
+func parseJobIDs(r *http.Request) ([]int, error) {
+	r.ParseForm()
+	ids := make([]int, 0, len(r.Form["id"]))
+	for _, value := range r.Form["id"] {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// deadLetterAction wraps a bulk action on dead-lettered jobs selected on the
+// dead letter page.
+func deadLetterAction(db *sqlx.DB, name string, action func(db *sqlx.DB, ids []int) (int64, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ids, err := parseJobIDs(r)
+		if err != nil {
+			slog.Info("Invalid job id", "handler", "DeadLetter", "action", name, "err", err)
+			renderDeadLetterPage(w, r, db, Message{
+				IsError:   true,
+				IsSuccess: false,
+				Content:   "Invalid job selection",
+			})
+			return
+		}
+
+		count, err := action(db, ids)
+		if err != nil {
+			slog.Error("Failed to run bulk action", "handler", "DeadLetter", "action", name, "err", err)
+			renderDeadLetterPage(w, r, db, Message{
+				IsError:   true,
+				IsSuccess: false,
+				Content:   "Failed to " + name + " jobs",
+			})
+			return
+		}
+
+		slog.Info("Ran bulk action on dead-lettered jobs", "action", name, "count", count)
+		http.Redirect(w, r, "/deadletter", http.StatusSeeOther)
+	}
+}
+
+func RequeueDeadLetters(db *sqlx.DB) http.HandlerFunc {
+	return deadLetterAction(db, "requeue", queue.Requeue)
+}
+
+func DiscardDeadLetters(db *sqlx.DB) http.HandlerFunc {
+	return deadLetterAction(db, "discard", queue.Discard)
+}
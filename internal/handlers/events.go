@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dusansimic/jobledger/internal/queue"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// eventBatchSize is how many events are read from the log at once
+	eventBatchSize = 500
+	// eventRecheckDelay is when a woken stream reads once more, for events
+	// that were held back by an older transaction still running
+	eventRecheckDelay = 2 * time.Second
+	// eventKeepAlive is how often an idle stream sends a comment, so
+	// proxies don't close the connection
+	eventKeepAlive = 15 * time.Second
+)
+
+// splitParam returns the comma separated values of a repeatable query
+// parameter.
+func splitParam(r *http.Request, name string) []string {
+	values := []string{}
+	for _, param := range r.URL.Query()[name] {
+		for _, value := range strings.Split(param, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+func parseEventFilter(r *http.Request) (queue.EventFilter, error) {
+	filter := queue.EventFilter{
+		Types:  splitParam(r, "type"),
+		States: splitParam(r, "state"),
+	}
+	for _, param := range splitParam(r, "job") {
+		id, err := strconv.Atoi(param)
+		if err != nil {
+			return filter, fmt.Errorf("invalid job id %q", param)
+		}
+		filter.JobIDs = append(filter.JobIDs, id)
+	}
+	return filter, nil
+}
+
+// StreamEvents streams job creations and state changes as Server-Sent
+// Events, filtered by the type, state and job query parameters. A client
+// that reconnects with the Last-Event-ID header, or the last_event_id
+// parameter, gets the events it missed in the meantime.
+func StreamEvents(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseEventFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		lastEventID := r.Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = r.URL.Query().Get("last_event_id")
+		}
+		var after int64
+		if lastEventID != "" {
+			after, err = strconv.ParseInt(lastEventID, 10, 64)
+			if err != nil {
+				http.Error(w, "Last-Event-ID must be an event id", http.StatusBadRequest)
+				return
+			}
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		cursor, err := queue.NewEventCursor(db, after)
+		if err != nil {
+			slog.Error("Failed to open event stream", "handler", "StreamEvents", "err", err)
+			http.Error(w, "failed to run query", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "retry: 3000\n\n")
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+		var recheck <-chan time.Time
+
+		for {
+			// taken before reading, so events written during the read still
+			// wake the stream
+			woken := queue.EventsAdded()
+
+			events, err := queue.ReadEvents(db, &cursor, eventBatchSize)
+			if err != nil {
+				slog.Error("Failed to read events", "handler", "StreamEvents", "err", err)
+				return
+			}
+
+			for _, event := range events {
+				if !filter.Matches(event) {
+					continue
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					slog.Error("Failed to encode event", "handler", "StreamEvents", "err", err)
+					return
+				}
+				_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Event, data)
+				if err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+
+			// a full batch means there are more events to catch up on
+			if len(events) == eventBatchSize {
+				continue
+			}
+
+			select {
+			case <-woken:
+				recheck = time.After(eventRecheckDelay)
+			case <-recheck:
+				recheck = nil
+			case <-keepAlive.C:
+				_, err = fmt.Fprint(w, ": keep-alive\n\n")
+				if err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/dusansimic/jobledger/internal/queue"
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// logBatchSize is how many lines are stored at once while a log upload
+	// is still being received, so followers see long uploads as they happen
+	logBatchSize = 500
+	// maxLogLineBytes is the longest log line that is accepted
+	maxLogLineBytes = 1 << 20
+)
+
+// logUpload is the response to a log upload. Lines is how many lines of the
+// upload were stored and Seq the sequence number of the last of them.
+type logUpload struct {
+	Error string `json:"error,omitempty"`
+	Lines int    `json:"lines"`
+	Seq   int64  `json:"seq,omitempty"`
+}
+
+// AppendJobLog stores log lines uploaded by the worker of a job. The body
+// is either plain text with one log line per line or, with the
+// application/x-ndjson content type, one {"line": "...", "time": "..."}
+// object per line. Chunked uploads are stored in batches as they arrive, so
+// when an upload fails partway the error response tells how many of its
+// lines were stored and a retry can continue after them.
+func AppendJobLog(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		ndjson := mediaType == "application/x-ndjson" || mediaType == "application/jsonl"
+
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxLogLineBytes)
+
+		batch := make([]queue.LogLine, 0, logBatchSize)
+		received := 0
+		upload := logUpload{}
+
+		respond := func(status int) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(upload)
+		}
+
+		flush := func() error {
+			seq, err := queue.AppendLog(db, id, batch)
+			if err != nil {
+				status, message := jobErrorStatus("AppendJobLog", err)
+				upload.Error = message
+				respond(status)
+				return err
+			}
+			if len(batch) > 0 {
+				upload.Lines += len(batch)
+				upload.Seq = seq
+			}
+			batch = batch[:0]
+			return nil
+		}
+
+		for scanner.Scan() {
+			line := queue.LogLine{}
+			if ndjson {
+				if len(scanner.Bytes()) == 0 {
+					continue
+				}
+				err := json.Unmarshal(scanner.Bytes(), &line)
+				if err != nil {
+					slog.Info("Failed to parse json", "handler", "AppendJobLog", "err", err)
+					upload.Error = "invalid json on line " + strconv.Itoa(received+1)
+					respond(http.StatusBadRequest)
+					return
+				}
+			} else {
+				line.Line = scanner.Text()
+			}
+
+			batch = append(batch, line)
+			received++
+
+			if len(batch) == logBatchSize {
+				if flush() != nil {
+					return
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			slog.Info("Failed to read log upload", "handler", "AppendJobLog", "err", err)
+			upload.Error = "failed to read log upload"
+			respond(http.StatusBadRequest)
+			return
+		}
+
+		if flush() != nil {
+			return
+		}
+		respond(http.StatusOK)
+	}
+}
+
+// GetJobLog returns the log lines of a job as JSON. Lines after a sequence
+// number are requested with ?after=, the last N lines with ?tail=N. Polling
+// with after set to the last seen sequence number follows the log.
+func GetJobLog(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		var after int64
+		var tail int
+		var err error
+
+		if param := r.URL.Query().Get("after"); param != "" {
+			after, err = strconv.ParseInt(param, 10, 64)
+			if err != nil {
+				http.Error(w, "after must be a sequence number", http.StatusBadRequest)
+				return
+			}
+		}
+		if param := r.URL.Query().Get("tail"); param != "" {
+			tail, err = strconv.Atoi(param)
+			if err != nil || tail < 0 {
+				http.Error(w, "tail must be a positive number of lines", http.StatusBadRequest)
+				return
+			}
+		}
+
+		lines, err := queue.ReadLog(db, id, after, tail)
+		if err != nil {
+			writeJobError(w, "GetJobLog", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(lines)
+	}
+}
@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/dusansimic/jobledger/internal/scheduler"
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+type SchedulesPageData struct {
+	Message   Message
+	Schedules []models.Schedule
+}
+
+func querySchedules(db *sqlx.DB) ([]models.Schedule, error) {
+	schedules := []models.Schedule{}
+	err := db.Select(&schedules, "SELECT * FROM schedule ORDER BY id ASC")
+	if err != nil {
+		slog.Error("Failed to query schedules", "handler", "QuerySchedules", "err", err)
+		return nil, err
+	}
+	return schedules, nil
+}
+
+func renderSchedulesPage(w http.ResponseWriter, db *sqlx.DB, message Message) {
+	schedules, err := querySchedules(db)
+	if err != nil {
+		http.Error(w, "failed to query schedules", http.StatusInternalServerError)
+		return
+	}
+
+	templates.ExecuteTemplate(w, "schedules.html", SchedulesPageData{
+		Message:   message,
+		Schedules: schedules,
+	})
+}
+
+func SchedulesPage(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderSchedulesPage(w, db, Message{
+			IsError:   false,
+			IsSuccess: false,
+		})
+	}
+}
+
+func CreateSchedule(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		name := strings.TrimSpace(r.FormValue("name"))
+		jobType := strings.TrimSpace(r.FormValue("type"))
+		expression := strings.TrimSpace(r.FormValue("cron"))
+		timezone := strings.TrimSpace(r.FormValue("timezone"))
+		metadataString := strings.TrimSpace(r.FormValue("metadata"))
+
+		fail := func(content string) {
+			renderSchedulesPage(w, db, Message{
+				IsError:   true,
+				IsSuccess: false,
+				Content:   content,
+			})
+		}
+
+		if name == "" || jobType == "" || expression == "" {
+			fail("Name, type and cron expression are required")
+			return
+		}
+		if timezone == "" {
+			timezone = "UTC"
+		}
+
+		var metadata models.MetadataMap
+		if metadataString != "" {
+			err := json.Unmarshal([]byte(metadataString), &metadata)
+			if err != nil {
+				fail("Metadata must be a JSON object")
+				return
+			}
+		}
+
+		err := scheduler.ValidateTemplates(name, metadata)
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+
+		nextRun, err := scheduler.NextRun(expression, timezone, time.Now())
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+
+		_, err = db.Exec(`
+			INSERT INTO schedule (name, type, cron, timezone, metadata, next_run_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, name, jobType, expression, timezone, metadata, nextRun)
+		if err != nil {
+			slog.Error("Failed to insert schedule", "handler", "CreateSchedule", "err", err)
+			fail("Failed to create schedule")
+			return
+		}
+		http.Redirect(w, r, "/schedules", http.StatusSeeOther)
+	}
+}
+
+// parseScheduleID reads the id of a schedule from the URL. It answers the
+// request itself if the id is not a number.
+func parseScheduleID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid schedule id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+func PauseSchedule(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseScheduleID(w, r)
+		if !ok {
+			return
+		}
+
+		result, err := db.Exec("UPDATE schedule SET paused = TRUE WHERE id = $1", id)
+		if err != nil {
+			slog.Error("Failed to pause schedule", "handler", "PauseSchedule", "id", id, "err", err)
+			http.Error(w, "failed to pause schedule", http.StatusInternalServerError)
+			return
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			http.Error(w, "schedule not found", http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, "/schedules", http.StatusSeeOther)
+	}
+}
+
+// ResumeSchedule unpauses a schedule. Runs missed while it was paused are
+// skipped, it fires next at the first time after now.
+func ResumeSchedule(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseScheduleID(w, r)
+		if !ok {
+			return
+		}
+
+		schedule := models.Schedule{}
+		err := db.Get(&schedule, "SELECT * FROM schedule WHERE id = $1", id)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "schedule not found", http.StatusNotFound)
+				return
+			}
+			slog.Error("Failed to query schedule", "handler", "ResumeSchedule", "id", id, "err", err)
+			http.Error(w, "failed to query schedule", http.StatusInternalServerError)
+			return
+		}
+
+		nextRun, err := scheduler.NextRun(schedule.Cron, schedule.Timezone, time.Now())
+		if err != nil {
+			renderSchedulesPage(w, db, Message{
+				IsError:   true,
+				IsSuccess: false,
+				Content:   err.Error(),
+			})
+			return
+		}
+
+		_, err = db.Exec("UPDATE schedule SET paused = FALSE, next_run_at = $1 WHERE id = $2", nextRun, id)
+		if err != nil {
+			slog.Error("Failed to resume schedule", "handler", "ResumeSchedule", "id", id, "err", err)
+			http.Error(w, "failed to resume schedule", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/schedules", http.StatusSeeOther)
+	}
+}
+
+func DeleteSchedule(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseScheduleID(w, r)
+		if !ok {
+			return
+		}
+
+		result, err := db.Exec("DELETE FROM schedule WHERE id = $1", id)
+		if err != nil {
+			slog.Error("Failed to delete schedule", "handler", "DeleteSchedule", "id", id, "err", err)
+			http.Error(w, "failed to delete schedule", http.StatusInternalServerError)
+			return
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			http.Error(w, "schedule not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
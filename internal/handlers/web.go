@@ -2,21 +2,45 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"time"
 
 	"github.com/dusansimic/jobledger/internal/auth"
 	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/dusansimic/jobledger/internal/queue"
 	"github.com/go-chi/chi/v5"
 	"github.com/jmoiron/sqlx"
 )
 
 var templateFuncMap = template.FuncMap{
+	"json": func(v any) string {
+		bytes, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return string(bytes)
+	},
+	"allowed":    queue.Allowed,
+	"pathescape": url.PathEscape,
+	"bytes": func(size int64) string {
+		const unit = 1024
+		if size < unit {
+			return fmt.Sprintf("%d B", size)
+		}
+		div, exp := int64(unit), 0
+		for n := size / unit; n >= unit; n /= unit {
+			div *= unit
+			exp++
+		}
+		return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+	},
 	"iterate": func(n int) []int {
 		r := make([]int, n)
 		for i := range r {
@@ -120,12 +144,61 @@ func (dd DurationData) DurationFormatted() string {
 	}
 }
 
+// runDuration returns how long something has been running, or how long it
+// ran if it already finished. Things that never started have no duration.
+func runDuration(startedAt, finishedAt *time.Time) DurationData {
+	if startedAt == nil {
+		return DurationData{
+			Duration: nil,
+			Expired:  false,
+		}
+	}
+
+	var duration time.Duration
+	if finishedAt == nil {
+		duration = time.Since(*startedAt)
+	} else {
+		duration = finishedAt.Sub(*startedAt)
+	}
+	return DurationData{
+		Duration: &duration,
+		Expired:  false,
+	}
+}
+
 type JobData struct {
-	ID       int
-	Name     string
-	Type     string
-	State    string
-	Duration DurationData
+	ID          int
+	Name        string
+	Type        string
+	State       string
+	Attempts    int
+	MaxAttempts int
+	Duration    DurationData
+	// ScheduledAt is set for jobs that are waiting for their run_at time
+	ScheduledAt *time.Time
+	// Progress is set for jobs in progress whose worker reported any
+	Progress *models.JobProgress
+}
+
+// newJobData prepares a job for a row of a jobs table.
+func newJobData(job models.Job) JobData {
+	data := JobData{
+		ID:          job.ID,
+		Name:        job.Name,
+		Type:        job.Type,
+		State:       job.State,
+		Attempts:    job.Attempts,
+		MaxAttempts: job.MaxAttempts,
+		Duration:    runDuration(job.StartedAt, job.CompletedAt),
+	}
+
+	if job.State == "notstarted" && job.RunAt.After(time.Now()) {
+		data.ScheduledAt = &job.RunAt
+	}
+	if job.State == "inprogress" {
+		data.Progress = job.Progress
+	}
+	return data
 }
 
 type PaginationData struct {
@@ -134,11 +207,23 @@ type PaginationData struct {
 	TotalPages int
 }
 
+// parsePage returns the page requested through the page query parameter,
+// defaulting to the first one.
+func parsePage(r *http.Request) int {
+	if pageParam := r.URL.Query().Get("page"); pageParam != "" {
+		if p, err := strconv.Atoi(pageParam); err == nil && p > 0 {
+			return p
+		}
+	}
+	return 1
+}
+
 type JobStats struct {
 	NumberJobs     int
 	PendingJobs    int
 	InProgressJobs int
-	FailedJobs     int
+	DeadLetterJobs int
+	CancelledJobs  int
 	CompletedJobs  int
 }
 
@@ -151,8 +236,8 @@ type DashboardData struct {
 func getJobStats(db *sqlx.DB) (*JobStats, error) {
 	stats := JobStats{}
 
-	// Query for getting pending, in-progress, failed, and completed jobs and total number of jobs
-	err := db.Get(&stats.PendingJobs, "SELECT COUNT(*) FROM job WHERE state = 'notstarted'")
+	// Query for getting pending, in-progress, dead-lettered, cancelled, and completed jobs and total number of jobs
+	err := db.Get(&stats.PendingJobs, "SELECT COUNT(*) FROM job WHERE state IN ('waiting', 'notstarted')")
 	if err != nil {
 		return nil, fmt.Errorf("failed to count pending jobs: %w", err)
 	}
@@ -160,9 +245,13 @@ func getJobStats(db *sqlx.DB) (*JobStats, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to count in-progress jobs: %w", err)
 	}
-	err = db.Get(&stats.FailedJobs, "SELECT COUNT(*) FROM job WHERE state = 'fail'")
+	err = db.Get(&stats.DeadLetterJobs, "SELECT COUNT(*) FROM job WHERE state = 'deadletter'")
 	if err != nil {
-		return nil, fmt.Errorf("failed to count failed jobs: %w", err)
+		return nil, fmt.Errorf("failed to count dead-lettered jobs: %w", err)
+	}
+	err = db.Get(&stats.CancelledJobs, "SELECT COUNT(*) FROM job WHERE state = 'cancelled'")
+	if err != nil {
+		return nil, fmt.Errorf("failed to count cancelled jobs: %w", err)
 	}
 	err = db.Get(&stats.CompletedJobs, "SELECT COUNT(*) FROM job WHERE state = 'complete'")
 	if err != nil {
@@ -179,15 +268,9 @@ func getJobStats(db *sqlx.DB) (*JobStats, error) {
 func Dashboard(db *sqlx.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Parse pagination parameters
-		page := 1
+		page := parsePage(r)
 		pageSize := 15
 
-		if pageParam := r.URL.Query().Get("page"); pageParam != "" {
-			if p, err := strconv.Atoi(pageParam); err == nil && p > 0 {
-				page = p
-			}
-		}
-
 		offset := (page - 1) * pageSize
 
 		// Get total number of jobs for pagination
@@ -219,33 +302,7 @@ func Dashboard(db *sqlx.DB) http.HandlerFunc {
 
 		jobsData := make([]JobData, len(jobs))
 		for i, job := range jobs {
-			jobsData[i] = JobData{
-				ID:    job.ID,
-				Name:  job.Name,
-				Type:  job.Type,
-				State: job.State,
-			}
-
-			if job.CompletedAt == nil {
-				if job.StartedAt == nil {
-					jobsData[i].Duration = DurationData{
-						Duration: nil,
-						Expired:  false,
-					}
-				} else {
-					duration := time.Since(*job.StartedAt)
-					jobsData[i].Duration = DurationData{
-						Duration: &duration,
-						Expired:  false,
-					}
-				}
-			} else {
-				duration := job.CompletedAt.Sub(*job.StartedAt)
-				jobsData[i].Duration = DurationData{
-					Duration: &duration,
-					Expired:  false,
-				}
-			}
+			jobsData[i] = newJobData(job)
 		}
 
 		// get job statistics
@@ -269,18 +326,222 @@ func Dashboard(db *sqlx.DB) http.HandlerFunc {
 	}
 }
 
+type AttemptData struct {
+	Attempt  models.JobAttempt
+	Duration DurationData
+}
+
+// DependencyData is a job on the other end of a dependency edge.
+type DependencyData struct {
+	ID        int    `db:"id"`
+	Name      string `db:"name"`
+	State     string `db:"state"`
+	OnFailure string `db:"on_failure"`
+}
+
+type JobPageData struct {
+	Job       models.Job
+	Duration  DurationData
+	Attempts  []AttemptData
+	Artifacts []models.JobArtifact
+	// Parents have to complete before the job may run, Children wait for it
+	Parents  []DependencyData
+	Children []DependencyData
+	// Worker is the worker that claimed the job last, if any
+	Worker *string
+	// Waited is the time between creating and starting the job
+	Waited DurationData
+	Events []queue.TimelineEntry
+	// Rebuilt is set when the events of the job have expired and the
+	// timeline was rebuilt from the job itself
+	Rebuilt bool
+}
+
 func JobPage(db *sqlx.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		jobID := chi.URLParam(r, "id")
-		job := models.Job{}
-		err := db.Get(&job, "SELECT * FROM job WHERE id = $1", jobID)
+		found, err := queue.Get(db, jobID)
 		if err != nil {
+			if errors.Is(err, queue.ErrJobNotFound) {
+				http.Error(w, "job not found", http.StatusNotFound)
+				return
+			}
 			slog.Error("Failed to query job", "handler", "JobPage", "id", jobID, "err", err)
+			http.Error(w, "failed to query job", http.StatusInternalServerError)
+			return
+		}
+		job := *found
+
+		attempts := []models.JobAttempt{}
+		err = db.Select(&attempts, "SELECT * FROM job_attempt WHERE job_id = $1 ORDER BY attempt DESC", job.ID)
+		if err != nil {
+			slog.Error("Failed to query job attempts", "handler", "JobPage", "id", jobID, "err", err)
+			http.Error(w, "failed to query job attempts", http.StatusInternalServerError)
+			return
+		}
+
+		artifacts, err := queue.ListArtifacts(db, jobID)
+		if err != nil {
+			slog.Error("Failed to query job artifacts", "handler", "JobPage", "id", jobID, "err", err)
+			http.Error(w, "failed to query job artifacts", http.StatusInternalServerError)
+			return
+		}
+
+		parents := []DependencyData{}
+		err = db.Select(&parents, `
+			SELECT job.id, job.name, job.state, d.on_failure
+			FROM job_dependency AS d
+			JOIN job ON job.id = d.parent_id
+			WHERE d.job_id = $1
+			ORDER BY job.id ASC
+		`, job.ID)
+		if err != nil {
+			slog.Error("Failed to query job dependencies", "handler", "JobPage", "id", jobID, "err", err)
+			http.Error(w, "failed to query job dependencies", http.StatusInternalServerError)
+			return
+		}
+
+		children := []DependencyData{}
+		err = db.Select(&children, `
+			SELECT job.id, job.name, job.state, d.on_failure
+			FROM job_dependency AS d
+			JOIN job ON job.id = d.job_id
+			WHERE d.parent_id = $1
+			ORDER BY job.id ASC
+		`, job.ID)
+		if err != nil {
+			slog.Error("Failed to query dependent jobs", "handler", "JobPage", "id", jobID, "err", err)
+			http.Error(w, "failed to query dependent jobs", http.StatusInternalServerError)
+			return
+		}
+
+		events, err := queue.JobEvents(db, job.ID)
+		if err != nil {
+			slog.Error("Failed to query job events", "handler", "JobPage", "id", jobID, "err", err)
+			http.Error(w, "failed to query job events", http.StatusInternalServerError)
+			return
+		}
+
+		attemptsData := make([]AttemptData, len(attempts))
+		for i, attempt := range attempts {
+			attemptsData[i] = AttemptData{
+				Attempt:  attempt,
+				Duration: runDuration(&attempt.StartedAt, attempt.FinishedAt),
+			}
+		}
+
+		timeline, rebuilt := queue.Timeline(&job, attempts, events)
+
+		// a requeued job forgets its worker, the attempts still know it
+		worker := job.ClaimedBy
+		if worker == nil && len(attempts) > 0 {
+			worker = attempts[0].ClaimedBy
+		}
+
+		waited := DurationData{}
+		if job.StartedAt != nil {
+			waited = runDuration(&job.CreatedAt, job.StartedAt)
+		}
+
+		templates.ExecuteTemplate(w, "job.html", JobPageData{
+			Job:       job,
+			Duration:  runDuration(job.StartedAt, job.CompletedAt),
+			Attempts:  attemptsData,
+			Artifacts: artifacts,
+			Parents:   parents,
+			Children:  children,
+			Worker:    worker,
+			Waited:    waited,
+			Events:    timeline,
+			Rebuilt:   rebuilt,
+		})
+	}
+}
+
+// redirectBack sends the user back to the dashboard page the request came
+// from, or to fallback if that is unknown.
+func redirectBack(w http.ResponseWriter, r *http.Request, fallback string) {
+	target := fallback
+	if referer, err := url.Parse(r.Referer()); err == nil && referer.Path != "" {
+		target = referer.Path
+		if referer.RawQuery != "" {
+			target += "?" + referer.RawQuery
+		}
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+func CancelJobForm(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jobID := chi.URLParam(r, "id")
+
+		_, err := queue.Cancel(db, jobID)
+		if err != nil {
+			switch {
+			case errors.Is(err, queue.ErrJobNotFound):
+				http.Error(w, "job not found", http.StatusNotFound)
+			case errors.Is(err, queue.ErrJobCancelled), errors.Is(err, queue.ErrInvalidState):
+				http.Error(w, "job can no longer be cancelled", http.StatusConflict)
+			default:
+				slog.Error("Failed to cancel job", "handler", "CancelJobForm", "id", jobID, "err", err)
+				http.Error(w, "failed to cancel job", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		redirectBack(w, r, "/job/"+jobID)
+	}
+}
+
+// RequeueJobForm gives a dead-lettered job a fresh set of attempts.
+func RequeueJobForm(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jobID := chi.URLParam(r, "id")
+		id, err := strconv.Atoi(jobID)
+		if err != nil {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+
+		requeued, err := queue.Requeue(db, []int{id})
+		if err != nil {
+			slog.Error("Failed to requeue job", "handler", "RequeueJobForm", "id", jobID, "err", err)
+			http.Error(w, "failed to requeue job", http.StatusInternalServerError)
+			return
+		}
+		if requeued == 0 {
+			http.Error(w, "only dead-lettered jobs can be requeued", http.StatusConflict)
+			return
+		}
+
+		redirectBack(w, r, "/job/"+jobID)
+	}
+}
+
+// CloneJobForm enqueues a copy of a job and opens the page of the copy.
+func CloneJobForm(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
 			http.Error(w, "job not found", http.StatusNotFound)
 			return
 		}
 
-		templates.ExecuteTemplate(w, "job.html", job)
+		job, err := queue.Clone(db, id)
+		if err != nil {
+			switch {
+			case errors.Is(err, queue.ErrJobNotFound):
+				http.Error(w, "job not found", http.StatusNotFound)
+			case errors.Is(err, queue.ErrInvalidJob):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			default:
+				slog.Error("Failed to clone job", "handler", "CloneJobForm", "id", id, "err", err)
+				http.Error(w, "failed to clone job", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		http.Redirect(w, r, "/job/"+strconv.Itoa(job.ID), http.StatusSeeOther)
 	}
 }
 
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/dusansimic/jobledger/internal/webhook"
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// webhookStates are the job states a webhook can be limited to
+var webhookStates = []string{"waiting", "notstarted", "inprogress", "complete", "cancelled", "deadletter"}
+
+type WebhooksPageData struct {
+	Message  Message
+	Webhooks []models.Webhook
+	States   []string
+}
+
+func renderWebhooksPage(w http.ResponseWriter, db *sqlx.DB, message Message) {
+	webhooks, err := webhook.List(db)
+	if err != nil {
+		slog.Error("Failed to query webhooks", "handler", "WebhooksPage", "err", err)
+		http.Error(w, "failed to query webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	templates.ExecuteTemplate(w, "webhooks.html", WebhooksPageData{
+		Message:  message,
+		Webhooks: webhooks,
+		States:   webhookStates,
+	})
+}
+
+func WebhooksPage(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderWebhooksPage(w, db, Message{
+			IsError:   false,
+			IsSuccess: false,
+		})
+	}
+}
+
+func CreateWebhook(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		types := []string{}
+		for _, t := range strings.Split(r.FormValue("types"), ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				types = append(types, t)
+			}
+		}
+
+		_, err := webhook.Create(db, models.Webhook{
+			URL:    strings.TrimSpace(r.FormValue("url")),
+			Secret: strings.TrimSpace(r.FormValue("secret")),
+			Types:  types,
+			States: r.Form["states"],
+		})
+		if err != nil {
+			content := "Failed to create webhook"
+			if errors.Is(err, webhook.ErrInvalidWebhook) {
+				content = err.Error()
+			} else {
+				slog.Error("Failed to create webhook", "handler", "CreateWebhook", "err", err)
+			}
+			renderWebhooksPage(w, db, Message{
+				IsError:   true,
+				IsSuccess: false,
+				Content:   content,
+			})
+			return
+		}
+		http.Redirect(w, r, "/webhooks", http.StatusSeeOther)
+	}
+}
+
+func PauseWebhook(db *sqlx.DB, paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := webhook.SetPaused(db, chi.URLParam(r, "id"), paused)
+		if err != nil {
+			if errors.Is(err, webhook.ErrWebhookNotFound) {
+				http.Error(w, "webhook not found", http.StatusNotFound)
+				return
+			}
+			slog.Error("Failed to update webhook", "handler", "PauseWebhook", "err", err)
+			renderWebhooksPage(w, db, Message{
+				IsError:   true,
+				IsSuccess: false,
+				Content:   "Failed to update webhook",
+			})
+			return
+		}
+		redirectBack(w, r, "/webhooks")
+	}
+}
+
+func DeleteWebhook(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := webhook.Delete(db, chi.URLParam(r, "id"))
+		if err != nil {
+			if errors.Is(err, webhook.ErrWebhookNotFound) {
+				http.Error(w, "webhook not found", http.StatusNotFound)
+				return
+			}
+			slog.Error("Failed to delete webhook", "handler", "DeleteWebhook", "err", err)
+			http.Error(w, "failed to delete webhook", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+type DeliveryData struct {
+	models.WebhookDelivery
+	Attempts []models.WebhookAttempt
+}
+
+type WebhookPageData struct {
+	Webhook    models.Webhook
+	Deliveries []DeliveryData
+	Pagination PaginationData
+}
+
+// WebhookPage shows the deliveries of a webhook together with the log of
+// every attempt at sending them.
+func WebhookPage(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		found, err := webhook.Get(db, id)
+		if err != nil {
+			if errors.Is(err, webhook.ErrWebhookNotFound) {
+				http.Error(w, "webhook not found", http.StatusNotFound)
+				return
+			}
+			slog.Error("Failed to query webhook", "handler", "WebhookPage", "id", id, "err", err)
+			http.Error(w, "failed to query webhook", http.StatusInternalServerError)
+			return
+		}
+
+		page := parsePage(r)
+		pageSize := 25
+		offset := (page - 1) * pageSize
+
+		var totalDeliveries int
+		err = db.Get(&totalDeliveries, "SELECT COUNT(*) FROM webhook_delivery WHERE webhook_id = $1", found.ID)
+		if err != nil {
+			slog.Error("Failed to count deliveries", "handler", "WebhookPage", "id", id, "err", err)
+			http.Error(w, "failed to count deliveries", http.StatusInternalServerError)
+			return
+		}
+
+		deliveries, err := webhook.Deliveries(db, found.ID, pageSize, offset)
+		if err != nil {
+			slog.Error("Failed to query deliveries", "handler", "WebhookPage", "id", id, "err", err)
+			http.Error(w, "failed to query deliveries", http.StatusInternalServerError)
+			return
+		}
+
+		deliveryIDs := make([]int64, len(deliveries))
+		for i, delivery := range deliveries {
+			deliveryIDs[i] = delivery.ID
+		}
+		attempts, err := webhook.Attempts(db, deliveryIDs)
+		if err != nil {
+			slog.Error("Failed to query delivery attempts", "handler", "WebhookPage", "id", id, "err", err)
+			http.Error(w, "failed to query delivery attempts", http.StatusInternalServerError)
+			return
+		}
+
+		byDelivery := map[int64][]models.WebhookAttempt{}
+		for _, attempt := range attempts {
+			byDelivery[attempt.DeliveryID] = append(byDelivery[attempt.DeliveryID], attempt)
+		}
+		deliveriesData := make([]DeliveryData, len(deliveries))
+		for i, delivery := range deliveries {
+			deliveriesData[i] = DeliveryData{
+				WebhookDelivery: delivery,
+				Attempts:        byDelivery[delivery.ID],
+			}
+		}
+
+		templates.ExecuteTemplate(w, "webhook.html", WebhookPageData{
+			Webhook:    *found,
+			Deliveries: deliveriesData,
+			Pagination: PaginationData{
+				Page:       page,
+				PageSize:   pageSize,
+				TotalPages: (totalDeliveries + pageSize - 1) / pageSize,
+			},
+		})
+	}
+}
+
+// RedeliverWebhook sends a delivery again, e.g. after the receiving end
+// was fixed.
+func RedeliverWebhook(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+
+		err := webhook.Redeliver(db, id, chi.URLParam(r, "delivery"))
+		if err != nil {
+			if errors.Is(err, webhook.ErrDeliveryNotFound) {
+				http.Error(w, "delivery not found", http.StatusNotFound)
+				return
+			}
+			slog.Error("Failed to redeliver webhook", "handler", "RedeliverWebhook", "err", err)
+			http.Error(w, "failed to redeliver webhook", http.StatusInternalServerError)
+			return
+		}
+		redirectBack(w, r, "/webhook/"+id)
+	}
+}
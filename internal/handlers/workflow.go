@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/dusansimic/jobledger/internal/workflow"
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// runsOnWorkflowsPage is how many of the latest runs the workflows page lists
+const runsOnWorkflowsPage = 20
+
+// writeWorkflowError responds to an API request that failed on a workflow.
+func writeWorkflowError(w http.ResponseWriter, handler string, err error) {
+	status := http.StatusInternalServerError
+	message := "failed to run query"
+
+	switch {
+	case errors.Is(err, workflow.ErrWorkflowNotFound):
+		status = http.StatusNotFound
+		message = "workflow not found"
+	case errors.Is(err, workflow.ErrRunNotFound):
+		status = http.StatusNotFound
+		message = "workflow run not found"
+	case errors.Is(err, workflow.ErrInvalidWorkflow):
+		status = http.StatusBadRequest
+		message = err.Error()
+	default:
+		slog.Error("Failed to run workflow query", "handler", handler, "err", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": message,
+	})
+}
+
+// SaveWorkflow creates or replaces the workflow named in the URL with the
+// definition in the body.
+func SaveWorkflow(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "name")
+
+		definition := workflow.Definition{}
+		err := json.NewDecoder(r.Body).Decode(&definition)
+		if err != nil {
+			slog.Info("Failed to parse json", "handler", "SaveWorkflow", "err", err)
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+
+		saved, err := workflow.Save(db, name, definition)
+		if err != nil {
+			writeWorkflowError(w, "SaveWorkflow", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(saved)
+	}
+}
+
+func ReadWorkflow(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		found, err := workflow.Get(db, chi.URLParam(r, "name"))
+		if err != nil {
+			writeWorkflowError(w, "ReadWorkflow", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(found)
+	}
+}
+
+type StartWorkflowRequest struct {
+	Inputs models.MetadataMap `json:"inputs"`
+}
+
+// StartWorkflow starts a run of the workflow named in the URL and responds
+// with the run and the jobs of its nodes.
+func StartWorkflow(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		request := StartWorkflowRequest{}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			slog.Info("Failed to parse json", "handler", "StartWorkflow", "err", err)
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+
+		run, err := workflow.Start(db, chi.URLParam(r, "name"), request.Inputs)
+		if err != nil {
+			writeWorkflowError(w, "StartWorkflow", err)
+			return
+		}
+
+		state, err := workflow.GetRun(db, strconv.Itoa(run.ID))
+		if err != nil {
+			writeWorkflowError(w, "StartWorkflow", err)
+			return
+		}
+
+		w.Header().Set("Location", fmt.Sprintf("/api/workflow-run/%d", run.ID))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(state)
+	}
+}
+
+func ReadWorkflowRun(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state, err := workflow.GetRun(db, chi.URLParam(r, "id"))
+		if err != nil {
+			writeWorkflowError(w, "ReadWorkflowRun", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(state)
+	}
+}
+
+type WorkflowData struct {
+	models.Workflow
+	// Nodes is the number of nodes in the definition
+	Nodes int
+}
+
+type WorkflowsPageData struct {
+	Message   Message
+	Workflows []WorkflowData
+	Runs      []workflow.RunState
+}
+
+func renderWorkflowsPage(w http.ResponseWriter, db *sqlx.DB, message Message) {
+	workflows, err := workflow.List(db)
+	if err != nil {
+		slog.Error("Failed to query workflows", "handler", "WorkflowsPage", "err", err)
+		http.Error(w, "failed to query workflows", http.StatusInternalServerError)
+		return
+	}
+
+	runs, err := workflow.ListRuns(db, runsOnWorkflowsPage)
+	if err != nil {
+		slog.Error("Failed to query workflow runs", "handler", "WorkflowsPage", "err", err)
+		http.Error(w, "failed to query workflow runs", http.StatusInternalServerError)
+		return
+	}
+
+	workflowsData := make([]WorkflowData, len(workflows))
+	for i, found := range workflows {
+		definition := workflow.Definition{}
+		json.Unmarshal(found.Definition, &definition)
+		workflowsData[i] = WorkflowData{Workflow: found, Nodes: len(definition.Nodes)}
+	}
+
+	templates.ExecuteTemplate(w, "workflows.html", WorkflowsPageData{
+		Message:   message,
+		Workflows: workflowsData,
+		Runs:      runs,
+	})
+}
+
+func WorkflowsPage(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderWorkflowsPage(w, db, Message{
+			IsError:   false,
+			IsSuccess: false,
+		})
+	}
+}
+
+// SaveWorkflowForm creates or replaces a workflow from the dashboard.
+func SaveWorkflowForm(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		name := strings.TrimSpace(r.FormValue("name"))
+		definitionString := strings.TrimSpace(r.FormValue("definition"))
+
+		fail := func(content string) {
+			renderWorkflowsPage(w, db, Message{
+				IsError:   true,
+				IsSuccess: false,
+				Content:   content,
+			})
+		}
+
+		definition := workflow.Definition{}
+		err := json.Unmarshal([]byte(definitionString), &definition)
+		if err != nil {
+			fail("Definition must be a JSON object with a list of nodes")
+			return
+		}
+
+		_, err = workflow.Save(db, name, definition)
+		if err != nil {
+			if errors.Is(err, workflow.ErrInvalidWorkflow) {
+				fail(err.Error())
+				return
+			}
+			slog.Error("Failed to save workflow", "handler", "SaveWorkflowForm", "err", err)
+			fail("Failed to save workflow")
+			return
+		}
+		http.Redirect(w, r, "/workflows", http.StatusSeeOther)
+	}
+}
+
+// StartWorkflowForm starts a run of a workflow from the dashboard and shows
+// its graph.
+func StartWorkflowForm(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		name := chi.URLParam(r, "name")
+		inputsString := strings.TrimSpace(r.FormValue("inputs"))
+
+		fail := func(content string) {
+			renderWorkflowsPage(w, db, Message{
+				IsError:   true,
+				IsSuccess: false,
+				Content:   content,
+			})
+		}
+
+		var inputs models.MetadataMap
+		if inputsString != "" {
+			err := json.Unmarshal([]byte(inputsString), &inputs)
+			if err != nil {
+				fail("Inputs must be a JSON object")
+				return
+			}
+		}
+
+		run, err := workflow.Start(db, name, inputs)
+		if err != nil {
+			if errors.Is(err, workflow.ErrInvalidWorkflow) || errors.Is(err, workflow.ErrWorkflowNotFound) {
+				fail(err.Error())
+				return
+			}
+			slog.Error("Failed to start workflow", "handler", "StartWorkflowForm", "err", err)
+			fail("Failed to start workflow")
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/workflow-run/%d", run.ID), http.StatusSeeOther)
+	}
+}
+
+func DeleteWorkflow(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := workflow.Delete(db, chi.URLParam(r, "name"))
+		if err != nil {
+			if errors.Is(err, workflow.ErrWorkflowNotFound) {
+				http.Error(w, "workflow not found", http.StatusNotFound)
+				return
+			}
+			slog.Error("Failed to delete workflow", "handler", "DeleteWorkflow", "err", err)
+			http.Error(w, "failed to delete workflow", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+type WorkflowNodeData struct {
+	Key   string
+	Type  string
+	After []string
+	// Job is nil when the job of the node has been deleted
+	Job *JobData
+}
+
+type WorkflowRunPageData struct {
+	Run   models.WorkflowRun
+	State string
+	// Levels holds the nodes in columns, every node is in the column right
+	// after its deepest dependency
+	Levels [][]WorkflowNodeData
+}
+
+func WorkflowRunPage(db *sqlx.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		runID := chi.URLParam(r, "id")
+
+		state, err := workflow.GetRun(db, runID)
+		if err != nil {
+			if errors.Is(err, workflow.ErrRunNotFound) {
+				http.Error(w, "workflow run not found", http.StatusNotFound)
+				return
+			}
+			slog.Error("Failed to query workflow run", "handler", "WorkflowRunPage", "id", runID, "err", err)
+			http.Error(w, "failed to query workflow run", http.StatusInternalServerError)
+			return
+		}
+
+		levels := [][]WorkflowNodeData{}
+		for _, node := range state.Nodes {
+			for len(levels) <= node.Level {
+				levels = append(levels, []WorkflowNodeData{})
+			}
+
+			data := WorkflowNodeData{
+				Key:  node.Node.Key,
+				Type: node.Node.Type,
+			}
+			for _, edge := range node.Node.DependsOn {
+				data.After = append(data.After, edge.Node)
+			}
+			if node.Job != nil {
+				job := newJobData(*node.Job)
+				data.Job = &job
+			}
+			levels[node.Level] = append(levels[node.Level], data)
+		}
+
+		templates.ExecuteTemplate(w, "workflow_run.html", WorkflowRunPageData{
+			Run:    state.Run,
+			State:  state.State,
+			Levels: levels,
+		})
+	}
+}
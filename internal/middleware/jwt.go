@@ -1,6 +1,9 @@
 package middleware
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"log/slog"
 	"net/http"
@@ -8,6 +11,30 @@ import (
 	"github.com/dusansimic/jobledger/internal/auth"
 )
 
+type contextKey string
+
+const appIDKey contextKey = "appID"
+
+// AppID returns the identity of the app token that authenticated the
+// request, or an empty string if the request did not pass RequireAppAuth.
+// It is recorded as the owner of claimed jobs, so every token has its own.
+func AppID(r *http.Request) string {
+	id, _ := r.Context().Value(appIDKey).(string)
+	return id
+}
+
+// appID derives the identity of an app token: its comment, which the
+// dashboard shows, followed by a fingerprint of the token, which tells apart
+// tokens with the same or no comment.
+func appID(token string, comment string) string {
+	sum := sha256.Sum256([]byte(token))
+	fingerprint := hex.EncodeToString(sum[:6])
+	if comment == "" {
+		return fingerprint
+	}
+	return comment + "#" + fingerprint
+}
+
 func RequireUserAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		cookie, err := r.Cookie("jwt")
@@ -44,6 +71,9 @@ func RequireAppAuth(next http.Handler) http.Handler {
 
 		slog.Info("Authenticated app", "comment", claims["comment"])
 
-		next.ServeHTTP(w, r)
+		comment, _ := claims["comment"].(string)
+		ctx := context.WithValue(r.Context(), appIDKey, appID(header, comment))
+
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// JobArtifact is a file a worker uploaded for a job. The contents live in
+// the blob store under BlobKey, JobID is nil once the job is deleted.
+type JobArtifact struct {
+	ID          int       `db:"id" json:"-"`
+	JobID       *int      `db:"job_id" json:"job_id"`
+	Name        string    `db:"name" json:"name"`
+	Size        int64     `db:"size" json:"size"`
+	Checksum    string    `db:"checksum" json:"sha256"`
+	ContentType string    `db:"content_type" json:"content_type"`
+	BlobKey     string    `db:"blob_key" json:"-"`
+	CreatedAt   time.Time `db:"created_at" json:"created_time"`
+}
@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+// Batch groups jobs that were created together. Once every job of a batch
+// has finished, the batch completes and fires its callback: either the job
+// described by CallbackJob is enqueued or CallbackURL is called.
+type Batch struct {
+	ID               int        `db:"id" json:"id"`
+	Name             string     `db:"name" json:"name"`
+	CreatedAt        time.Time  `db:"created_at" json:"created_time"`
+	CompletedAt      *time.Time `db:"completed_at" json:"completed_time"`
+	CallbackJob      JSONValue  `db:"callback_job" json:"callback_job,omitempty"`
+	CallbackJobID    *int       `db:"callback_job_id" json:"callback_job_id,omitempty"`
+	CallbackURL      *string    `db:"callback_url" json:"callback_url,omitempty"`
+	CallbackSecret   *string    `db:"callback_secret" json:"-"`
+	CallbackState    *string    `db:"callback_state" json:"callback_state,omitempty"`
+	CallbackAttempts int        `db:"callback_attempts" json:"-"`
+	CallbackNextAt   *time.Time `db:"callback_next_at" json:"-"`
+	CallbackError    *string    `db:"callback_error" json:"callback_error,omitempty"`
+}
+
+// BatchStats counts the jobs of a batch by state. Failed jobs are the ones
+// that were dead-lettered.
+type BatchStats struct {
+	Total      int `db:"total" json:"total"`
+	Pending    int `db:"pending" json:"pending"`
+	InProgress int `db:"inprogress" json:"inprogress"`
+	Complete   int `db:"complete" json:"complete"`
+	Failed     int `db:"failed" json:"failed"`
+	Cancelled  int `db:"cancelled" json:"cancelled"`
+}
+
+// BatchSummary is a batch together with the aggregate state of its jobs.
+type BatchSummary struct {
+	Batch
+	BatchStats
+}
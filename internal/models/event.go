@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// JobEvent records a job being created, changing its state or reporting
+// progress. Event is either created, state_changed or progress.
+// PreviousState is only set for state changes, Progress only for progress.
+type JobEvent struct {
+	ID            int64        `db:"id" json:"id"`
+	JobID         int          `db:"job_id" json:"job_id"`
+	Event         string       `db:"event" json:"event"`
+	JobName       string       `db:"job_name" json:"name"`
+	JobType       string       `db:"job_type" json:"type"`
+	State         string       `db:"state" json:"state"`
+	PreviousState *string      `db:"previous_state" json:"previous_state,omitempty"`
+	Progress      *JobProgress `db:"progress" json:"progress,omitempty"`
+	CreatedAt     time.Time    `db:"created_at" json:"time"`
+}
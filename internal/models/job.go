@@ -4,12 +4,17 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
+	"slices"
 	"time"
 )
 
 type MetadataMap map[string]interface{}
 
 func (m *MetadataMap) Scan(src interface{}) error {
+	if src == nil {
+		*m = nil
+		return nil
+	}
 	bytes, ok := src.([]byte)
 	if !ok {
 		return fmt.Errorf("failed to unmarshal MetadataMap value: %v", src)
@@ -18,16 +23,127 @@ func (m *MetadataMap) Scan(src interface{}) error {
 }
 
 func (m MetadataMap) Value() (driver.Value, error) {
+	if m == nil {
+		return nil, nil
+	}
 	return json.Marshal(m)
 }
 
+// JSONValue is an arbitrary JSON value stored in a JSONB column, such as
+// the result of a job. Unlike json.RawMessage it can be scanned from and
+// written to a NULL column, which is how a JSON null is stored.
+type JSONValue []byte
+
+func (v *JSONValue) Scan(src interface{}) error {
+	if src == nil {
+		*v = nil
+		return nil
+	}
+	bytes, ok := src.([]byte)
+	if !ok {
+		return fmt.Errorf("failed to unmarshal JSONValue value: %v", src)
+	}
+	*v = slices.Clone(bytes)
+	return nil
+}
+
+func (v JSONValue) Value() (driver.Value, error) {
+	if len(v) == 0 {
+		return nil, nil
+	}
+	return string(v), nil
+}
+
+func (v JSONValue) MarshalJSON() ([]byte, error) {
+	if len(v) == 0 {
+		return []byte("null"), nil
+	}
+	return v, nil
+}
+
+func (v *JSONValue) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*v = nil
+		return nil
+	}
+	*v = slices.Clone(data)
+	return nil
+}
+
+// JobError describes why an attempt of a job failed, as reported by the
+// worker.
+type JobError struct {
+	Message string `json:"message"`
+	Code    string `json:"code,omitempty"`
+	Stack   string `json:"stack,omitempty"`
+}
+
+func (e *JobError) Scan(src interface{}) error {
+	bytes, ok := src.([]byte)
+	if !ok {
+		return fmt.Errorf("failed to unmarshal JobError value: %v", src)
+	}
+	return json.Unmarshal(bytes, e)
+}
+
+func (e JobError) Value() (driver.Value, error) {
+	return json.Marshal(e)
+}
+
+// JobProgress is the latest progress reported by the worker of a job.
+type JobProgress struct {
+	Percent  float64            `json:"percent"`
+	Step     string             `json:"step,omitempty"`
+	Counters map[string]float64 `json:"counters,omitempty"`
+}
+
+func (p *JobProgress) Scan(src interface{}) error {
+	bytes, ok := src.([]byte)
+	if !ok {
+		return fmt.Errorf("failed to unmarshal JobProgress value: %v", src)
+	}
+	return json.Unmarshal(bytes, p)
+}
+
+func (p JobProgress) Value() (driver.Value, error) {
+	return json.Marshal(p)
+}
+
 type Job struct {
-	ID          int         `db:"id" json:"id"`
-	Name        string      `db:"name" json:"name"`
-	Type        string      `db:"type" json:"type"`
-	State       string      `db:"state" json:"state"`
-	CreatedAt   time.Time   `db:"created_at" json:"created_time"`
-	StartedAt   *time.Time  `db:"started_at" json:"started_time"`
-	CompletedAt *time.Time  `db:"completed_at" json:"completed_time"`
-	Metadata    MetadataMap `db:"metadata" json:"metadata"`
+	ID             int          `db:"id" json:"id"`
+	Name           string       `db:"name" json:"name"`
+	Type           string       `db:"type" json:"type"`
+	State          string       `db:"state" json:"state"`
+	CreatedAt      time.Time    `db:"created_at" json:"created_time"`
+	StartedAt      *time.Time   `db:"started_at" json:"started_time"`
+	CompletedAt    *time.Time   `db:"completed_at" json:"completed_time"`
+	Metadata       MetadataMap  `db:"metadata" json:"metadata"`
+	ClaimedBy      *string      `db:"claimed_by" json:"claimed_by"`
+	LeaseExpiresAt *time.Time   `db:"lease_expires_at" json:"lease_expires_time"`
+	Attempts       int          `db:"attempts" json:"attempts"`
+	MaxAttempts    int          `db:"max_attempts" json:"max_attempts"`
+	Backoff        string       `db:"backoff" json:"backoff"`
+	BackoffDelay   int          `db:"backoff_delay" json:"backoff_delay"`
+	RunAt          time.Time    `db:"run_at" json:"run_time"`
+	LastError      *string      `db:"last_error" json:"last_error"`
+	Priority       int          `db:"priority" json:"priority"`
+	Result         JSONValue    `db:"result" json:"result"`
+	Error          *JobError    `db:"error" json:"error"`
+	Progress       *JobProgress `db:"progress" json:"progress"`
+	UniqueKey      *string      `db:"unique_key" json:"unique_key"`
+	BatchID        *int         `db:"batch_id" json:"batch_id"`
+	WorkflowRunID  *int         `db:"workflow_run_id" json:"workflow_run_id"`
+	WorkflowNode   *string      `db:"workflow_node" json:"workflow_node"`
+}
+
+// JobAttempt is a single run of a job by a worker.
+type JobAttempt struct {
+	ID         int        `db:"id" json:"id"`
+	JobID      int        `db:"job_id" json:"job_id"`
+	Attempt    int        `db:"attempt" json:"attempt"`
+	ClaimedBy  *string    `db:"claimed_by" json:"claimed_by"`
+	State      string     `db:"state" json:"state"`
+	Reason     *string    `db:"reason" json:"reason"`
+	StartedAt  time.Time  `db:"started_at" json:"started_time"`
+	FinishedAt *time.Time `db:"finished_at" json:"finished_time"`
 }
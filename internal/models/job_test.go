@@ -0,0 +1,62 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestJSONValue(t *testing.T) {
+	tests := []struct {
+		body   string
+		result string
+		stored any
+	}{
+		{`{"result": {"image": "app"}}`, `{"image": "app"}`, `{"image": "app"}`},
+		{`{"result": [1, 2]}`, `[1, 2]`, `[1, 2]`},
+		{`{"result": "done"}`, `"done"`, `"done"`},
+		{`{"result": 42}`, `42`, `42`},
+		{`{"result": null}`, `null`, nil},
+		{`{}`, `null`, nil},
+	}
+
+	for _, test := range tests {
+		var payload struct {
+			Result JSONValue `json:"result"`
+		}
+		err := json.Unmarshal([]byte(test.body), &payload)
+		if err != nil {
+			t.Errorf("Unmarshal(%s): %v", test.body, err)
+			continue
+		}
+
+		stored, err := payload.Result.Value()
+		if err != nil || stored != test.stored {
+			t.Errorf("Value of %s = %#v, %v, want %#v", test.body, stored, err, test.stored)
+		}
+
+		var scanned JSONValue
+		if stored != nil {
+			err = scanned.Scan([]byte(stored.(string)))
+		} else {
+			err = scanned.Scan(nil)
+		}
+		if err != nil {
+			t.Errorf("Scan of %s: %v", test.body, err)
+			continue
+		}
+
+		encoded, err := json.Marshal(scanned)
+		if err != nil || string(encoded) != compact(t, test.result) {
+			t.Errorf("Marshal of %s = %s, %v, want %s", test.body, encoded, err, test.result)
+		}
+	}
+}
+
+func compact(t *testing.T, s string) string {
+	var v any
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err)
+	}
+	encoded, _ := json.Marshal(v)
+	return string(encoded)
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// JobLogLine is a single line of output a worker uploaded for a job.
+type JobLogLine struct {
+	ID        int64     `db:"id" json:"-"`
+	JobID     int       `db:"job_id" json:"job_id"`
+	Seq       int64     `db:"seq" json:"seq"`
+	Line      string    `db:"line" json:"line"`
+	CreatedAt time.Time `db:"created_at" json:"time"`
+}
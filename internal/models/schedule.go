@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+type Schedule struct {
+	ID        int         `db:"id" json:"id"`
+	Name      string      `db:"name" json:"name"`
+	Type      string      `db:"type" json:"type"`
+	Cron      string      `db:"cron" json:"cron"`
+	Timezone  string      `db:"timezone" json:"timezone"`
+	Metadata  MetadataMap `db:"metadata" json:"metadata"`
+	Paused    bool        `db:"paused" json:"paused"`
+	NextRunAt time.Time   `db:"next_run_at" json:"next_run_time"`
+	LastRunAt *time.Time  `db:"last_run_at" json:"last_run_time"`
+	CreatedAt time.Time   `db:"created_at" json:"created_time"`
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Webhook is a subscription to job events. Empty Types or States match
+// every job type or state.
+type Webhook struct {
+	ID        int            `db:"id" json:"id"`
+	URL       string         `db:"url" json:"url"`
+	Secret    string         `db:"secret" json:"-"`
+	Types     pq.StringArray `db:"types" json:"types"`
+	States    pq.StringArray `db:"states" json:"states"`
+	Paused    bool           `db:"paused" json:"paused"`
+	CreatedAt time.Time      `db:"created_at" json:"created_time"`
+}
+
+// WebhookDelivery is an event sent, or still to be sent, to a webhook.
+type WebhookDelivery struct {
+	ID            int64           `db:"id" json:"id"`
+	WebhookID     int             `db:"webhook_id" json:"webhook_id"`
+	EventID       int64           `db:"event_id" json:"event_id"`
+	Event         string          `db:"event" json:"event"`
+	Payload       json.RawMessage `db:"payload" json:"payload"`
+	State         string          `db:"state" json:"state"`
+	Attempts      int             `db:"attempts" json:"attempts"`
+	NextAttemptAt *time.Time      `db:"next_attempt_at" json:"next_attempt_time"`
+	LastError     *string         `db:"last_error" json:"last_error"`
+	CreatedAt     time.Time       `db:"created_at" json:"created_time"`
+}
+
+// WebhookAttempt is a single try at sending a delivery. StatusCode is nil
+// when no response was received.
+type WebhookAttempt struct {
+	ID         int64     `db:"id" json:"id"`
+	DeliveryID int64     `db:"delivery_id" json:"delivery_id"`
+	Attempt    int       `db:"attempt" json:"attempt"`
+	StatusCode *int      `db:"status_code" json:"status_code"`
+	Error      *string   `db:"error" json:"error"`
+	DurationMs int       `db:"duration_ms" json:"duration_ms"`
+	CreatedAt  time.Time `db:"created_at" json:"created_time"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Workflow is a reusable template of jobs and the dependencies between
+// them. The definition is kept as JSON, see the workflow package.
+type Workflow struct {
+	ID         int             `db:"id" json:"id"`
+	Name       string          `db:"name" json:"name"`
+	Definition json.RawMessage `db:"definition" json:"definition"`
+	CreatedAt  time.Time       `db:"created_at" json:"created_time"`
+	UpdatedAt  time.Time       `db:"updated_at" json:"updated_time"`
+}
+
+// WorkflowRun is a started workflow. Every node of its definition became a
+// job pointing back at the run.
+type WorkflowRun struct {
+	ID           int             `db:"id" json:"id"`
+	WorkflowID   *int            `db:"workflow_id" json:"workflow_id"`
+	WorkflowName string          `db:"workflow_name" json:"workflow_name"`
+	Definition   json.RawMessage `db:"definition" json:"definition"`
+	Inputs       MetadataMap     `db:"inputs" json:"inputs"`
+	CreatedAt    time.Time       `db:"created_at" json:"created_time"`
+}
@@ -0,0 +1,108 @@
+package queue
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/dusansimic/jobledger/internal/blob"
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrArtifactNotFound = errors.New("artifact not found")
+
+// AddArtifact records an artifact whose contents are already in the blob
+// store on an in-progress job. An artifact with the same name is replaced,
+// its blob is deleted by the sweeper.
+func AddArtifact(db *sqlx.DB, id string, artifact models.JobArtifact) (*models.JobArtifact, error) {
+	_, err := withJob(db, id, "artifact", func(tx *sqlx.Tx, job *models.Job) error {
+		_, err := tx.Exec("UPDATE job_artifact SET job_id = NULL WHERE job_id = $1 AND name = $2", job.ID, artifact.Name)
+		if err != nil {
+			return fmt.Errorf("failed to detach previous artifact: %w", err)
+		}
+
+		err = tx.Get(&artifact, `
+			INSERT INTO job_artifact (job_id, name, size, checksum, content_type, blob_key)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING *;
+		`, job.ID, artifact.Name, artifact.Size, artifact.Checksum, artifact.ContentType, artifact.BlobKey)
+		if err != nil {
+			return fmt.Errorf("failed to add artifact: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &artifact, nil
+}
+
+// ListArtifacts returns the artifacts of a job ordered by name.
+func ListArtifacts(db *sqlx.DB, id string) ([]models.JobArtifact, error) {
+	jobID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var exists bool
+	err = db.Get(&exists, "SELECT EXISTS (SELECT 1 FROM job WHERE id = $1)", jobID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query job: %w", err)
+	}
+	if !exists {
+		return nil, ErrJobNotFound
+	}
+
+	artifacts := []models.JobArtifact{}
+	err = db.Select(&artifacts, "SELECT * FROM job_artifact WHERE job_id = $1 ORDER BY name ASC", jobID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query artifacts: %w", err)
+	}
+	return artifacts, nil
+}
+
+// GetArtifact returns the artifact of a job with the given name.
+func GetArtifact(db *sqlx.DB, id string, name string) (*models.JobArtifact, error) {
+	jobID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	artifact := models.JobArtifact{}
+	err = db.Get(&artifact, "SELECT * FROM job_artifact WHERE job_id = $1 AND name = $2", jobID, name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrArtifactNotFound
+		}
+		return nil, fmt.Errorf("failed to query artifact: %w", err)
+	}
+	return &artifact, nil
+}
+
+// sweepArtifacts deletes the blobs of artifacts that no longer belong to a
+// job, either because the job was deleted or the artifact was replaced. An
+// artifact whose blob can't be deleted is kept and retried on the next run.
+func sweepArtifacts(db *sqlx.DB, store blob.BlobStore) error {
+	artifacts := []models.JobArtifact{}
+	err := db.Select(&artifacts, "SELECT * FROM job_artifact WHERE job_id IS NULL ORDER BY id ASC LIMIT 100")
+	if err != nil {
+		return fmt.Errorf("failed to query detached artifacts: %w", err)
+	}
+
+	for _, artifact := range artifacts {
+		err = store.Delete(context.Background(), artifact.BlobKey)
+		if err != nil {
+			slog.Error("Failed to delete artifact blob", "reaper", "retention", "key", artifact.BlobKey, "err", err)
+			continue
+		}
+
+		_, err = db.Exec("DELETE FROM job_artifact WHERE id = $1", artifact.ID)
+		if err != nil {
+			return fmt.Errorf("failed to delete artifact: %w", err)
+		}
+	}
+	return nil
+}
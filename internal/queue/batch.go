@@ -0,0 +1,473 @@
+package queue
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/dusansimic/jobledger/internal/signature"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const (
+	CALLBACK_PENDING   = "pending"
+	CALLBACK_DELIVERED = "delivered"
+	CALLBACK_FAILED    = "failed"
+)
+
+const (
+	// callbackInterval is how often pending batch webhooks are sent
+	callbackInterval = 5 * time.Second
+	// callbackBatchSize is how many batch webhooks are claimed at once
+	callbackBatchSize = 10
+	// callbackTimeout is how long a callback url has to respond
+	callbackTimeout = 10 * time.Second
+	// callbackClaimTimeout is how long claimed batch webhooks are kept from
+	// other replicas, it has to cover sending all of them
+	callbackClaimTimeout = callbackBatchSize*callbackTimeout + time.Minute
+	// callbackMaxAttempts is how many times a batch webhook is tried
+	callbackMaxAttempts = 5
+	// callbackBackoff is the delay before the first retry of a webhook, it
+	// doubles with every further attempt
+	callbackBackoff = 10 * time.Second
+)
+
+var (
+	ErrBatchNotFound = errors.New("batch not found")
+	// ErrInvalidBatch is returned by CreateBatch when the batch itself is
+	// invalid, invalid jobs are reported with ErrInvalidJob.
+	ErrInvalidBatch = errors.New("invalid batch")
+)
+
+var callbackClient = &http.Client{Timeout: callbackTimeout}
+
+// NewBatch describes a batch and its jobs. It doubles as the JSON payload of
+// the batch creation API.
+type NewBatch struct {
+	Name     string         `json:"name"`
+	Jobs     []NewJob       `json:"jobs"`
+	Callback *BatchCallback `json:"callback"`
+}
+
+// BatchCallback is what happens when a batch completes, either Job is
+// enqueued or URL receives a POST request with the batch summary. The
+// request is signed with Secret, which is generated if left empty.
+type BatchCallback struct {
+	Job    *NewJob `json:"job"`
+	URL    string  `json:"url"`
+	Secret string  `json:"secret"`
+}
+
+// validate checks the batch itself, its jobs are validated when they are
+// enqueued.
+func (b *NewBatch) validate() error {
+	if b.Name == "" {
+		return fmt.Errorf("%w: batch name is required", ErrInvalidBatch)
+	}
+	if len(b.Jobs) == 0 {
+		return fmt.Errorf("%w: a batch needs at least one job", ErrInvalidBatch)
+	}
+	if b.Callback == nil {
+		return nil
+	}
+
+	if (b.Callback.Job == nil) == (b.Callback.URL == "") {
+		return fmt.Errorf("%w: callback needs either a job or a url", ErrInvalidBatch)
+	}
+	if b.Callback.URL != "" {
+		u, err := url.Parse(b.Callback.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%w: callback url must be an http or https url", ErrInvalidBatch)
+		}
+	}
+	if b.Callback.Job != nil {
+		// normalize fills in defaults, so validate a copy
+		job := *b.Callback.Job
+		_, err := job.normalize()
+		if err != nil {
+			return fmt.Errorf("callback job: %w", err)
+		}
+	}
+	return nil
+}
+
+// CreateBatch creates a batch and enqueues its jobs in one transaction.
+// Jobs are enqueued like with EnqueueBulk, jobs whose unique key is taken
+// are not part of the batch.
+func CreateBatch(db *sqlx.DB, b NewBatch, atomic bool) (*models.Batch, []BulkResult, error) {
+	err := b.validate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	results, err := EnqueueBulkTx(tx, b.Jobs, atomic)
+	if err != nil {
+		return nil, results, err
+	}
+
+	members := []int{}
+	valid := false
+	for _, result := range results {
+		if result.Created {
+			members = append(members, result.ID)
+		}
+		valid = valid || result.Error == ""
+	}
+	if !valid {
+		return nil, results, fmt.Errorf("%w: none of the jobs are valid", ErrInvalidJob)
+	}
+
+	var callbackJob, callbackURL, callbackSecret *string
+	if b.Callback != nil && b.Callback.Job != nil {
+		encoded, err := json.Marshal(b.Callback.Job)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encode callback job: %w", err)
+		}
+		callbackJob = new(string)
+		*callbackJob = string(encoded)
+	}
+	if b.Callback != nil && b.Callback.URL != "" {
+		callbackURL = &b.Callback.URL
+		if b.Callback.Secret == "" {
+			b.Callback.Secret, err = signature.NewSecret()
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		callbackSecret = &b.Callback.Secret
+	}
+
+	batch := models.Batch{}
+	err = tx.Get(&batch, `
+		INSERT INTO batch (name, callback_job, callback_url, callback_secret)
+		VALUES ($1, $2, $3, $4)
+		RETURNING *;
+	`, b.Name, callbackJob, callbackURL, callbackSecret)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to insert batch: %w", err)
+	}
+
+	_, err = tx.Exec("UPDATE job SET batch_id = $1 WHERE id = ANY($2)", batch.ID, pq.Array(members))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to add jobs to batch: %w", err)
+	}
+
+	// a batch without new jobs, e.g. when all of them were duplicates, is
+	// complete right away
+	err = checkBatch(tx, batch.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = tx.Get(&batch, "SELECT * FROM batch WHERE id = $1", batch.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to reload batch: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &batch, results, nil
+}
+
+// batchStatsQuery aggregates the jobs of batches, it is joined onto the
+// batch table.
+const batchStatsQuery = `
+	COUNT(job.id) AS total,
+	COUNT(job.id) FILTER (WHERE job.state IN ('waiting', 'notstarted')) AS pending,
+	COUNT(job.id) FILTER (WHERE job.state = 'inprogress') AS inprogress,
+	COUNT(job.id) FILTER (WHERE job.state = 'complete') AS complete,
+	COUNT(job.id) FILTER (WHERE job.state = 'deadletter') AS failed,
+	COUNT(job.id) FILTER (WHERE job.state = 'cancelled') AS cancelled
+`
+
+// GetBatch returns a batch with the aggregate state of its jobs.
+func GetBatch(db *sqlx.DB, id string) (*models.BatchSummary, error) {
+	batchID, err := parseID(id)
+	if err != nil {
+		return nil, ErrBatchNotFound
+	}
+	return batchSummary(db, batchID)
+}
+
+func batchSummary(q sqlx.Queryer, batchID int) (*models.BatchSummary, error) {
+	summary := models.BatchSummary{}
+	err := sqlx.Get(q, &summary, `
+		SELECT batch.*, `+batchStatsQuery+`
+		FROM batch
+		LEFT JOIN job ON job.batch_id = batch.id
+		WHERE batch.id = $1
+		GROUP BY batch.id;
+	`, batchID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrBatchNotFound
+		}
+		return nil, fmt.Errorf("failed to query batch: %w", err)
+	}
+	return &summary, nil
+}
+
+// ListBatches returns a page of batches, newest first, with the aggregate
+// state of their jobs.
+func ListBatches(db *sqlx.DB, limit int, offset int) ([]models.BatchSummary, error) {
+	summaries := []models.BatchSummary{}
+	err := db.Select(&summaries, `
+		SELECT batch.*, `+batchStatsQuery+`
+		FROM batch
+		LEFT JOIN job ON job.batch_id = batch.id
+		GROUP BY batch.id
+		ORDER BY batch.id DESC
+		LIMIT $1 OFFSET $2;
+	`, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query batches: %w", err)
+	}
+	return summaries, nil
+}
+
+// checkBatch completes a batch once all of its jobs have finished and fires
+// its callback. Every transaction that finishes a job of the batch calls
+// it after updating the job; the lock on the batch row makes sure the last
+// of them sees all the others.
+func checkBatch(tx *sqlx.Tx, batchID int) error {
+	batch := models.Batch{}
+	err := tx.Get(&batch, "SELECT * FROM batch WHERE id = $1 FOR UPDATE", batchID)
+	if err != nil {
+		return fmt.Errorf("failed to lock batch: %w", err)
+	}
+	if batch.CompletedAt != nil {
+		return nil
+	}
+
+	var running bool
+	err = tx.Get(&running, `
+		SELECT EXISTS (
+			SELECT 1 FROM job
+			WHERE batch_id = $1 AND state NOT IN ('complete', 'cancelled', 'deadletter')
+		);
+	`, batchID)
+	if err != nil {
+		return fmt.Errorf("failed to query batch jobs: %w", err)
+	}
+	if running {
+		return nil
+	}
+
+	_, err = tx.Exec(`
+		UPDATE batch
+		SET completed_at = CURRENT_TIMESTAMP,
+			callback_state = CASE WHEN callback_url IS NOT NULL THEN 'pending' END,
+			callback_next_at = CASE WHEN callback_url IS NOT NULL THEN CURRENT_TIMESTAMP END
+		WHERE id = $1;
+	`, batchID)
+	if err != nil {
+		return fmt.Errorf("failed to complete batch: %w", err)
+	}
+
+	if batch.CallbackJob != nil {
+		return enqueueCallbackJob(tx, &batch)
+	}
+	return nil
+}
+
+// reopenBatch takes back the completion of a batch after one of its jobs
+// was requeued, so that the batch completes, and fires its callback, again
+// once the job has finished. A callback that is being sent is not recorded.
+func reopenBatch(tx *sqlx.Tx, batchID int) error {
+	_, err := tx.Exec(`
+		UPDATE batch
+		SET completed_at = NULL, callback_state = NULL, callback_attempts = 0,
+			callback_next_at = NULL, callback_error = NULL
+		WHERE id = $1 AND completed_at IS NOT NULL;
+	`, batchID)
+	if err != nil {
+		return fmt.Errorf("failed to reopen batch: %w", err)
+	}
+	return nil
+}
+
+// enqueueCallbackJob enqueues the callback job of a completed batch. The
+// summary of the batch is added to its metadata under the batch key.
+func enqueueCallbackJob(tx *sqlx.Tx, batch *models.Batch) error {
+	job := NewJob{}
+	err := json.Unmarshal(batch.CallbackJob, &job)
+	if err != nil {
+		return fmt.Errorf("failed to decode callback job: %w", err)
+	}
+
+	summary, err := batchSummary(tx, batch.ID)
+	if err != nil {
+		return err
+	}
+	if job.Metadata == nil {
+		job.Metadata = models.MetadataMap{}
+	}
+	job.Metadata["batch"] = summary
+
+	created, _, err := EnqueueTx(tx, job)
+	if err != nil {
+		if errors.Is(err, ErrInvalidJob) {
+			slog.Error("Batch callback job is invalid", "callback", "batch", "id", batch.ID, "err", err)
+			return nil
+		}
+		return fmt.Errorf("failed to enqueue callback job: %w", err)
+	}
+
+	_, err = tx.Exec("UPDATE batch SET callback_job_id = $1 WHERE id = $2", created.ID, batch.ID)
+	if err != nil {
+		return fmt.Errorf("failed to store callback job: %w", err)
+	}
+	return nil
+}
+
+// claimCallbacks takes up to callbackBatchSize due batch webhooks for
+// sending. Their next attempt is pushed back by callbackClaimTimeout before
+// the transaction commits, so no other replica picks them up while they are
+// being sent and no batch row stays locked during the requests.
+func claimCallbacks(db *sqlx.DB) ([]models.Batch, error) {
+	batches := []models.Batch{}
+	err := db.Select(&batches, `
+		UPDATE batch
+		SET callback_next_at = CURRENT_TIMESTAMP + make_interval(secs => $1)
+		WHERE id IN (
+			SELECT id FROM batch
+			WHERE callback_state = 'pending' AND callback_next_at <= CURRENT_TIMESTAMP
+			ORDER BY callback_next_at ASC
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *;
+	`, callbackClaimTimeout.Seconds(), callbackBatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim pending callbacks: %w", err)
+	}
+	return batches, nil
+}
+
+// recordCallback stores the outcome of a batch webhook. A failed delivery
+// is retried with exponential backoff until callbackMaxAttempts is reached.
+func recordCallback(db *sqlx.DB, batch *models.Batch, deliveryErr error) error {
+	var err error
+	if deliveryErr == nil {
+		_, err = db.Exec(`
+			UPDATE batch
+			SET callback_state = 'delivered', callback_attempts = callback_attempts + 1,
+				callback_next_at = NULL, callback_error = NULL
+			WHERE id = $1 AND callback_state = 'pending';
+		`, batch.ID)
+	} else {
+		attempts := batch.CallbackAttempts + 1
+		state := CALLBACK_PENDING
+		if attempts >= callbackMaxAttempts {
+			state = CALLBACK_FAILED
+		}
+		delay := callbackBackoff * time.Duration(1<<(attempts-1))
+		_, err = db.Exec(`
+			UPDATE batch
+			SET callback_state = $1, callback_attempts = $2,
+				callback_next_at = CURRENT_TIMESTAMP + make_interval(secs => $3),
+				callback_error = $4
+			WHERE id = $5 AND callback_state = 'pending';
+		`, state, attempts, delay.Seconds(), deliveryErr.Error(), batch.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update callback: %w", err)
+	}
+	return nil
+}
+
+// sendCallbacks delivers due batch webhooks. The requests are sent outside
+// of any transaction.
+func sendCallbacks(db *sqlx.DB) error {
+	batches, err := claimCallbacks(db)
+	if err != nil {
+		return err
+	}
+
+	for _, batch := range batches {
+		deliveryErr := deliverCallback(db, &batch)
+		if deliveryErr != nil {
+			slog.Warn("Failed to deliver batch callback", "callback", "batch", "id", batch.ID, "err", deliveryErr)
+		}
+
+		err = recordCallback(db, &batch, deliveryErr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverCallback posts the summary of a completed batch to its callback
+// url. Any response other than 2xx counts as a failure.
+func deliverCallback(db *sqlx.DB, batch *models.Batch) error {
+	summary, err := batchSummary(db, batch.ID)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"event": "batch.completed",
+		"batch": summary,
+	})
+	if err != nil {
+		return err
+	}
+	return postCallback(*batch.CallbackURL, batch.CallbackSecret, body)
+}
+
+// postCallback sends the body of a batch webhook, signed with the secret of
+// the batch. Batches created before callbacks were signed have no secret.
+func postCallback(callbackURL string, secret *string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "jobledger-webhook")
+	req.Header.Set("X-Jobledger-Event", "batch.completed")
+	if secret != nil {
+		req.Header.Set(signature.Header, signature.Sign(*secret, time.Now(), body))
+	}
+
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// RunBatchCallbacks periodically delivers the webhooks of completed
+// batches. It never returns and is meant to be started in a goroutine.
+func RunBatchCallbacks(db *sqlx.DB) {
+	ticker := time.NewTicker(callbackInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := sendCallbacks(db)
+		if err != nil {
+			slog.Error("Failed to send batch callbacks", "callback", "batch", "err", err)
+		}
+	}
+}
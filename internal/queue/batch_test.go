@@ -0,0 +1,57 @@
+package queue
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dusansimic/jobledger/internal/signature"
+)
+
+func TestPostCallback(t *testing.T) {
+	var header http.Header
+	var body []byte
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	payload := []byte(`{"event":"batch.completed"}`)
+	secret := "batch-secret"
+	err := postCallback(server.URL, &secret, payload)
+	if err != nil {
+		t.Fatalf("postCallback: %v", err)
+	}
+	if string(body) != string(payload) || header.Get("X-Jobledger-Event") != "batch.completed" {
+		t.Errorf("callback got %s with headers %v", body, header)
+	}
+
+	sig := header.Get(signature.Header)
+	timestamp, _, _ := strings.Cut(strings.TrimPrefix(sig, "t="), ",")
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sent, 0)).Abs() > time.Minute {
+		t.Fatalf("signature %q doesn't carry the current time", sig)
+	}
+	if want := signature.Sign(secret, time.Unix(sent, 0), payload); sig != want {
+		t.Errorf("signature = %q, want %q", sig, want)
+	}
+
+	// batches from before callbacks were signed have no secret
+	err = postCallback(server.URL, nil, payload)
+	if err != nil || header.Get(signature.Header) != "" {
+		t.Errorf("postCallback without a secret = %v, signature %q", err, header.Get(signature.Header))
+	}
+
+	status = http.StatusBadGateway
+	err = postCallback(server.URL, &secret, payload)
+	if err == nil {
+		t.Error("postCallback to a failing url succeeded")
+	}
+}
@@ -0,0 +1,195 @@
+package queue
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// bulkChunkSize is how many jobs are inserted by a single statement.
+const bulkChunkSize = 1000
+
+// BulkResult is the outcome of enqueueing one job of a bulk request. A job
+// that was not created either failed validation and carries an error, or
+// its unique key was taken and the id is the one of the existing job.
+type BulkResult struct {
+	Index   int    `json:"index"`
+	ID      int    `json:"id,omitempty"`
+	Created bool   `json:"created"`
+	Error   string `json:"error,omitempty"`
+}
+
+// EnqueueBulk enqueues many jobs in one transaction using multi-row
+// inserts. Results are returned in the order of the jobs. If atomic is set
+// and any job is invalid, nothing is enqueued and ErrInvalidJob is returned
+// with the results; otherwise invalid jobs are skipped.
+func EnqueueBulk(db *sqlx.DB, jobs []NewJob, atomic bool) ([]BulkResult, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	results, err := EnqueueBulkTx(tx, jobs, atomic)
+	if err != nil {
+		return results, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return results, nil
+}
+
+// EnqueueBulkTx is EnqueueBulk within an existing transaction.
+func EnqueueBulkTx(tx *sqlx.Tx, jobs []NewJob, atomic bool) ([]BulkResult, error) {
+	results := make([]BulkResult, len(jobs))
+	delays := make([]time.Duration, len(jobs))
+	invalid := false
+
+	for i := range jobs {
+		results[i].Index = i
+		delay, err := jobs[i].normalize()
+		if err != nil {
+			results[i].Error = err.Error()
+			invalid = true
+			continue
+		}
+		delays[i] = delay
+	}
+	if invalid && atomic {
+		return results, ErrInvalidJob
+	}
+
+	// jobs with a unique key or dependencies go through the regular path,
+	// which takes care of them, the rest is inserted in chunks
+	plain := []int{}
+	for i := range jobs {
+		if results[i].Error != "" {
+			continue
+		}
+		if jobs[i].UniqueKey == "" && len(jobs[i].DependsOn) == 0 {
+			plain = append(plain, i)
+			continue
+		}
+
+		job, created, err := EnqueueTx(tx, jobs[i])
+		if errors.Is(err, ErrInvalidJob) {
+			// nothing was written for the job, e.g. it depends on an
+			// unknown job
+			results[i].Error = err.Error()
+			if atomic {
+				// the transaction is rolled back, so nothing was created
+				for k := range results {
+					results[k].ID = 0
+					results[k].Created = false
+				}
+				return results, ErrInvalidJob
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		results[i].ID = job.ID
+		results[i].Created = created
+	}
+
+	for start := 0; start < len(plain); start += bulkChunkSize {
+		chunk := plain[start:min(start+bulkChunkSize, len(plain))]
+		err := insertChunk(tx, jobs, delays, results, chunk)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// insertChunk inserts the jobs at the given indexes with one statement.
+// Ids are taken from the sequence up front, so every job's id is known
+// without relying on the order of the inserted rows.
+func insertChunk(tx *sqlx.Tx, jobs []NewJob, delays []time.Duration, results []BulkResult, indexes []int) error {
+	ids := []int64{}
+	err := tx.Select(&ids, `
+		SELECT nextval(pg_get_serial_sequence('job', 'id'))
+		FROM generate_series(1, $1);
+	`, len(indexes))
+	if err != nil {
+		return fmt.Errorf("failed to allocate job ids: %w", err)
+	}
+
+	n := len(indexes)
+	names := make([]string, n)
+	types := make([]string, n)
+	metadata := make([]sql.NullString, n)
+	maxAttempts := make([]int64, n)
+	backoffs := make([]string, n)
+	backoffDelays := make([]int64, n)
+	runAts := make([]string, n)
+	delaySeconds := make([]float64, n)
+	priorities := make([]int64, n)
+
+	for k, i := range indexes {
+		j := jobs[i]
+		names[k] = j.Name
+		types[k] = j.Type
+		if j.Metadata != nil {
+			encoded, err := json.Marshal(j.Metadata)
+			if err != nil {
+				return fmt.Errorf("failed to encode metadata: %w", err)
+			}
+			metadata[k] = sql.NullString{String: string(encoded), Valid: true}
+		}
+		maxAttempts[k] = int64(*j.MaxAttempts)
+		backoffs[k] = *j.Backoff
+		backoffDelays[k] = int64(*j.BackoffDelay)
+		if j.RunAt != nil {
+			runAts[k] = j.RunAt.Format(time.RFC3339Nano)
+		}
+		delaySeconds[k] = delays[i].Seconds()
+		priorities[k] = int64(j.Priority)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO job (id, name, type, state, created_at, metadata,
+			max_attempts, backoff, backoff_delay, run_at, priority)
+		SELECT t.id, t.name, t.type, 'notstarted', CURRENT_TIMESTAMP, CAST(t.metadata AS JSONB),
+			t.max_attempts, t.backoff, t.backoff_delay,
+			COALESCE(
+				CAST(CAST(NULLIF(t.run_at, '') AS TIMESTAMPTZ) AS TIMESTAMP),
+				CURRENT_TIMESTAMP + make_interval(secs => t.delay)
+			),
+			t.priority
+		FROM unnest($1::bigint[], $2::text[], $3::text[], $4::text[], $5::bigint[],
+			$6::text[], $7::bigint[], $8::text[], $9::float8[], $10::bigint[])
+			AS t(id, name, type, metadata, max_attempts, backoff, backoff_delay, run_at, delay, priority);
+	`, pq.Array(ids), pq.Array(names), pq.Array(types), pq.Array(metadata), pq.Array(maxAttempts),
+		pq.Array(backoffs), pq.Array(backoffDelays), pq.Array(runAts), pq.Array(delaySeconds), pq.Array(priorities))
+	if err != nil {
+		return fmt.Errorf("failed to insert jobs: %w", err)
+	}
+
+	notified := map[string]bool{}
+	for _, jobType := range types {
+		if notified[jobType] {
+			continue
+		}
+		notified[jobType] = true
+		err = notifyAvailable(tx, jobType)
+		if err != nil {
+			return err
+		}
+	}
+
+	for k, i := range indexes {
+		results[i].ID = int(ids[k])
+		results[i].Created = true
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package queue
+
+import (
+	"fmt"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// deadLetter moves a job to the terminal deadletter state, keeping the
+// details of its last failure.
+func deadLetter(tx *sqlx.Tx, job *models.Job, jobErr models.JobError) error {
+	_, err := tx.Exec(`
+		UPDATE job
+		SET state = 'deadletter', completed_at = CURRENT_TIMESTAMP, lease_expires_at = NULL,
+			last_error = $1, error = $2
+		WHERE id = $3;
+	`, jobErr.Message, jobErr, job.ID)
+	if err != nil {
+		return fmt.Errorf("failed to dead-letter job: %w", err)
+	}
+	return jobFinished(tx, job)
+}
+
+// Reject dead-letters a job straight away, regardless of the attempts it has
+// left. Workers use it for jobs that can never succeed, e.g. invalid input.
+func Reject(db *sqlx.DB, id string, claimedBy string, jobErr models.JobError) (*models.Job, error) {
+	return withClaimedJob(db, id, "reject", claimedBy, func(tx *sqlx.Tx, job *models.Job) error {
+		err := finishAttempt(tx, job, "rejected", &jobErr.Message)
+		if err != nil {
+			return err
+		}
+		return deadLetter(tx, job, jobErr)
+	})
+}
+
+// lockJobs loads the jobs with the given ids that allow the operation and
+// locks their rows until the transaction ends. The other jobs are skipped.
+func lockJobs(tx *sqlx.Tx, ids []int, operation string) ([]models.Job, error) {
+	jobs := []models.Job{}
+	err := tx.Select(&jobs, "SELECT * FROM job WHERE id = ANY($1) ORDER BY id ASC FOR UPDATE", pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock jobs: %w", err)
+	}
+
+	allowed := jobs[:0]
+	for _, job := range jobs {
+		if checkTransition(&job, operation) == nil {
+			allowed = append(allowed, job)
+		}
+	}
+	return allowed, nil
+}
+
+// Requeue gives dead-lettered jobs a fresh set of attempts and returns how
+// many jobs were requeued. Jobs that are not dead-lettered are left alone.
+// The error of the last failure is cleared, the batch of a job is reopened
+// and the jobs that were given up on because of the failure wait for the
+// job again.
+func Requeue(db *sqlx.DB, ids []int) (int64, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	jobs, err := lockJobs(tx, ids, "requeue")
+	if err != nil {
+		return 0, err
+	}
+	if len(jobs) == 0 {
+		return 0, nil
+	}
+
+	for _, job := range jobs {
+		err = requeue(tx, &job)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return int64(len(jobs)), nil
+}
+
+// requeue moves a locked dead-lettered job back to notstarted.
+func requeue(tx *sqlx.Tx, job *models.Job) error {
+	_, err := tx.Exec(`
+		UPDATE job
+		SET state = 'notstarted', attempts = 0, run_at = CURRENT_TIMESTAMP,
+			started_at = NULL, completed_at = NULL, claimed_by = NULL, lease_expires_at = NULL,
+			last_error = NULL, error = NULL, progress = NULL
+		WHERE id = $1;
+	`, job.ID)
+	if err != nil {
+		return fmt.Errorf("failed to requeue job: %w", err)
+	}
+
+	err = notifyAvailable(tx, job.Type)
+	if err != nil {
+		return err
+	}
+
+	if job.BatchID != nil {
+		err = reopenBatch(tx, *job.BatchID)
+		if err != nil {
+			return err
+		}
+	}
+	return reopenChildren(tx, job.ID, job.State)
+}
+
+// Discard deletes dead-lettered jobs together with their attempt history
+// and returns how many jobs were deleted. Their artifacts are deleted by the
+// retention sweeper.
+func Discard(db *sqlx.DB, ids []int) (int64, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	jobs, err := lockJobs(tx, ids, "discard")
+	if err != nil {
+		return 0, err
+	}
+	if len(jobs) == 0 {
+		return 0, nil
+	}
+
+	discarded := make([]int, len(jobs))
+	for i, job := range jobs {
+		discarded[i] = job.ID
+	}
+	_, err = tx.Exec("DELETE FROM job WHERE id = ANY($1)", pq.Array(discarded))
+	if err != nil {
+		return 0, fmt.Errorf("failed to discard jobs: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return int64(len(jobs)), nil
+}
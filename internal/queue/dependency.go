@@ -0,0 +1,253 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// What happens to a waiting job when one of its parents is dead-lettered or
+// cancelled instead of completing.
+const (
+	// DEPENDENCY_CANCEL cancels the job, this is the default
+	DEPENDENCY_CANCEL = "cancel"
+	// DEPENDENCY_FAIL dead-letters the job
+	DEPENDENCY_FAIL = "fail"
+	// DEPENDENCY_IGNORE treats the parent as if it completed
+	DEPENDENCY_IGNORE = "ignore"
+)
+
+// Dependency is an edge from a new job to a parent job that has to complete
+// before the new job may run. In JSON it is either the id of the parent or
+// an object such as {"id": 12, "on_failure": "ignore"}.
+type Dependency struct {
+	ID        int    `json:"id"`
+	OnFailure string `json:"on_failure"`
+}
+
+func (d *Dependency) UnmarshalJSON(data []byte) error {
+	var id int
+	if err := json.Unmarshal(data, &id); err == nil {
+		*d = Dependency{ID: id}
+		return nil
+	}
+
+	type dependency Dependency
+	return json.Unmarshal(data, (*dependency)(d))
+}
+
+func ValidDependencyPolicy(policy string) bool {
+	switch policy {
+	case DEPENDENCY_CANCEL, DEPENDENCY_FAIL, DEPENDENCY_IGNORE:
+		return true
+	}
+	return false
+}
+
+// lockParents checks that the parents of a new job exist and share locks
+// them, so none of them can finish unnoticed while the job is being
+// created.
+func lockParents(tx *sqlx.Tx, dependencies []Dependency) error {
+	ids := make([]int, len(dependencies))
+	for i, dependency := range dependencies {
+		ids[i] = dependency.ID
+	}
+
+	found := []int{}
+	err := tx.Select(&found, "SELECT id FROM job WHERE id = ANY($1) ORDER BY id FOR SHARE", pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("failed to lock parent jobs: %w", err)
+	}
+	for _, id := range ids {
+		if !slices.Contains(found, id) {
+			return fmt.Errorf("%w: depends_on references unknown job %d", ErrInvalidJob, id)
+		}
+	}
+	return nil
+}
+
+// addDependencies records the parents of a freshly inserted waiting job and
+// releases it right away if they have all finished already. The parents
+// have to be locked with lockParents first.
+func addDependencies(tx *sqlx.Tx, job *models.Job, dependencies []Dependency) error {
+	ids := make([]int, len(dependencies))
+	policies := make([]string, len(dependencies))
+	for i, dependency := range dependencies {
+		ids[i] = dependency.ID
+		policies[i] = dependency.OnFailure
+	}
+
+	_, err := tx.Exec(`
+		INSERT INTO job_dependency (job_id, parent_id, on_failure)
+		SELECT $1, t.parent_id, t.on_failure
+		FROM unnest($2::int[], $3::text[]) AS t(parent_id, on_failure)
+		ON CONFLICT DO NOTHING;
+	`, job.ID, pq.Array(ids), pq.Array(policies))
+	if err != nil {
+		return fmt.Errorf("failed to add dependencies: %w", err)
+	}
+
+	return resolveDependencies(tx, job.ID)
+}
+
+// releaseChildren resolves the waiting jobs that depend on a job which has
+// just finished.
+func releaseChildren(tx *sqlx.Tx, job *models.Job) error {
+	children := []int{}
+	err := tx.Select(&children, `
+		SELECT d.job_id
+		FROM job_dependency AS d
+		JOIN job ON job.id = d.job_id
+		WHERE d.parent_id = $1 AND job.state = 'waiting'
+		ORDER BY d.job_id;
+	`, job.ID)
+	if err != nil {
+		return fmt.Errorf("failed to query dependent jobs: %w", err)
+	}
+
+	for _, child := range children {
+		err = resolveDependencies(tx, child)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveDependencies looks at the parents of a waiting job. Once all of
+// them have completed the job becomes claimable. If a parent was
+// dead-lettered or cancelled, the policy of the edge decides whether the
+// job is cancelled, dead-lettered or keeps waiting for the rest.
+func resolveDependencies(tx *sqlx.Tx, jobID int) error {
+	job := models.Job{}
+	err := tx.Get(&job, "SELECT * FROM job WHERE id = $1 FOR UPDATE", jobID)
+	if err != nil {
+		return fmt.Errorf("failed to lock job: %w", err)
+	}
+	if job.State != "waiting" {
+		return nil
+	}
+
+	edges := []struct {
+		ParentID  int    `db:"parent_id"`
+		OnFailure string `db:"on_failure"`
+		State     string `db:"state"`
+	}{}
+	err = tx.Select(&edges, `
+		SELECT d.parent_id, d.on_failure, job.state
+		FROM job_dependency AS d
+		JOIN job ON job.id = d.parent_id
+		WHERE d.job_id = $1
+		ORDER BY d.parent_id;
+	`, jobID)
+	if err != nil {
+		return fmt.Errorf("failed to query dependencies: %w", err)
+	}
+
+	waiting := false
+	for _, edge := range edges {
+		switch edge.State {
+		case "complete":
+		case "deadletter", "cancelled":
+			if edge.OnFailure == DEPENDENCY_IGNORE {
+				continue
+			}
+
+			jobErr := dependencyError(edge.ParentID, edge.State)
+			if edge.OnFailure == DEPENDENCY_FAIL {
+				return deadLetter(tx, &job, jobErr)
+			}
+			return cancelWaiting(tx, &job, jobErr)
+		default:
+			waiting = true
+		}
+	}
+	if waiting {
+		return nil
+	}
+
+	_, err = tx.Exec("UPDATE job SET state = 'notstarted' WHERE id = $1", jobID)
+	if err != nil {
+		return fmt.Errorf("failed to release job: %w", err)
+	}
+	return notifyAvailable(tx, job.Type)
+}
+
+// dependencyError is the error of a job that was given up on because its
+// parent finished in the given state.
+func dependencyError(parentID int, state string) models.JobError {
+	verb := "failed"
+	if state == "cancelled" {
+		verb = "was cancelled"
+	}
+	return models.JobError{
+		Message: fmt.Sprintf("dependency #%d %s", parentID, verb),
+		Code:    "dependency_" + state,
+	}
+}
+
+// reopenChildren puts the jobs that were given up on because of a parent
+// back to waiting, after the parent was requeued from the given state. The
+// jobs given up on because of them are reopened in turn. Each reopened job
+// has its dependencies resolved again, so one that still has another failed
+// parent is given up on right away.
+func reopenChildren(tx *sqlx.Tx, parentID int, state string) error {
+	jobErr := dependencyError(parentID, state)
+	children := []models.Job{}
+	err := tx.Select(&children, `
+		SELECT job.*
+		FROM job_dependency AS d
+		JOIN job ON job.id = d.job_id
+		WHERE d.parent_id = $1 AND job.state IN ('cancelled', 'deadletter') AND job.last_error = $2
+		ORDER BY job.id
+		FOR UPDATE OF job;
+	`, parentID, jobErr.Message)
+	if err != nil {
+		return fmt.Errorf("failed to query dependent jobs: %w", err)
+	}
+
+	for _, child := range children {
+		_, err = tx.Exec(`
+			UPDATE job
+			SET state = 'waiting', completed_at = NULL, last_error = NULL, error = NULL
+			WHERE id = $1;
+		`, child.ID)
+		if err != nil {
+			return fmt.Errorf("failed to reopen dependent job: %w", err)
+		}
+		if child.BatchID != nil {
+			err = reopenBatch(tx, *child.BatchID)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = reopenChildren(tx, child.ID, child.State)
+		if err != nil {
+			return err
+		}
+		err = resolveDependencies(tx, child.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cancelWaiting cancels a waiting job because of one of its parents, which
+// cascades to the jobs waiting for it in turn.
+func cancelWaiting(tx *sqlx.Tx, job *models.Job, jobErr models.JobError) error {
+	_, err := tx.Exec(`
+		UPDATE job
+		SET state = 'cancelled', completed_at = CURRENT_TIMESTAMP, last_error = $1, error = $2
+		WHERE id = $3;
+	`, jobErr.Message, jobErr, job.ID)
+	if err != nil {
+		return fmt.Errorf("failed to cancel job: %w", err)
+	}
+	return jobFinished(tx, job)
+}
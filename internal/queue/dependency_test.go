@@ -0,0 +1,52 @@
+package queue
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDependencyUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		json    string
+		want    Dependency
+		wantErr bool
+	}{
+		{json: `12`, want: Dependency{ID: 12}},
+		{json: `{"id": 12}`, want: Dependency{ID: 12}},
+		{json: `{"id": 12, "on_failure": "ignore"}`, want: Dependency{ID: 12, OnFailure: DEPENDENCY_IGNORE}},
+		{json: `{"on_failure": "fail", "id": 3}`, want: Dependency{ID: 3, OnFailure: DEPENDENCY_FAIL}},
+		{json: `"12"`, wantErr: true},
+		{json: `1.5`, wantErr: true},
+		{json: `[12]`, wantErr: true},
+		{json: `{"id": "12"}`, wantErr: true},
+	}
+	for _, test := range tests {
+		dependency := Dependency{}
+		err := json.Unmarshal([]byte(test.json), &dependency)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("Unmarshal(%s) = %+v, want an error", test.json, dependency)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unmarshal(%s): %v", test.json, err)
+			continue
+		}
+		if dependency != test.want {
+			t.Errorf("Unmarshal(%s) = %+v, want %+v", test.json, dependency, test.want)
+		}
+	}
+}
+
+func TestDependencyList(t *testing.T) {
+	job := NewJob{}
+	err := json.Unmarshal([]byte(`{"depends_on": [4, {"id": 5, "on_failure": "cancel"}]}`), &job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Dependency{{ID: 4}, {ID: 5, OnFailure: DEPENDENCY_CANCEL}}
+	if len(job.DependsOn) != len(want) || job.DependsOn[0] != want[0] || job.DependsOn[1] != want[1] {
+		t.Errorf("DependsOn = %+v, want %+v", job.DependsOn, want)
+	}
+}
@@ -0,0 +1,286 @@
+package queue
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"time"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrInvalidJob is returned by Enqueue when the job description is invalid.
+var ErrInvalidJob = errors.New("invalid job")
+
+// UniqueWindow is how long the unique key of a job keeps another job with
+// the same key from being enqueued.
+var UniqueWindow = 24 * time.Hour
+
+func init() {
+	if value := os.Getenv("JOB_UNIQUE_WINDOW"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			slog.Error("JOB_UNIQUE_WINDOW is not a valid duration", "value", value)
+			os.Exit(1)
+		}
+		UniqueWindow = duration
+	}
+}
+
+// NewJob describes a job to be enqueued. It doubles as the JSON payload of
+// the job creation API. Optional fields left empty fall back to defaults.
+type NewJob struct {
+	Name         string             `json:"name"`
+	Type         string             `json:"type"`
+	Metadata     models.MetadataMap `json:"metadata"`
+	MaxAttempts  *int               `json:"max_attempts"`
+	Backoff      *string            `json:"backoff"`
+	BackoffDelay *int               `json:"backoff_delay"`
+	Priority     int                `json:"priority"`
+	RunAt        *time.Time         `json:"run_at"`
+	Delay        string             `json:"delay"`
+	// UniqueKey makes enqueueing idempotent. While the key is taken, by
+	// default for UniqueWindow or with UniqueWhileActive until its job has
+	// finished, enqueueing a job with the same key returns the existing job.
+	UniqueKey         string `json:"unique_key"`
+	UniqueWhileActive bool   `json:"unique_while_active"`
+	// DependsOn lists jobs that have to complete before this one may run,
+	// until then the job is waiting.
+	DependsOn []Dependency `json:"depends_on"`
+}
+
+// normalize fills in the defaults of optional fields, validates the job and
+// returns the delay before the job may run.
+func (j *NewJob) normalize() (time.Duration, error) {
+	if j.MaxAttempts == nil {
+		maxAttempts := DefaultMaxAttempts
+		j.MaxAttempts = &maxAttempts
+	}
+	if j.Backoff == nil {
+		backoff := BACKOFF_FIXED
+		j.Backoff = &backoff
+	}
+	if j.BackoffDelay == nil {
+		backoffDelay := DefaultBackoffDelay
+		j.BackoffDelay = &backoffDelay
+	}
+
+	// the columns of these fields are INTEGER
+	if *j.MaxAttempts < 1 || *j.MaxAttempts > math.MaxInt32 {
+		return 0, fmt.Errorf("%w: max_attempts must be between 1 and %d", ErrInvalidJob, math.MaxInt32)
+	}
+	if !ValidBackoff(*j.Backoff) {
+		return 0, fmt.Errorf("%w: backoff must be fixed, exponential or exponential_jitter", ErrInvalidJob)
+	}
+	if *j.BackoffDelay < 0 || *j.BackoffDelay > math.MaxInt32 {
+		return 0, fmt.Errorf("%w: backoff_delay must be between 0 and %d", ErrInvalidJob, math.MaxInt32)
+	}
+	if j.Priority < math.MinInt32 || j.Priority > math.MaxInt32 {
+		return 0, fmt.Errorf("%w: priority must be between %d and %d", ErrInvalidJob, math.MinInt32, math.MaxInt32)
+	}
+	if j.UniqueWhileActive && j.UniqueKey == "" {
+		return 0, fmt.Errorf("%w: unique_while_active requires a unique_key", ErrInvalidJob)
+	}
+	for i := range j.DependsOn {
+		if j.DependsOn[i].OnFailure == "" {
+			j.DependsOn[i].OnFailure = DEPENDENCY_CANCEL
+		}
+		if !ValidDependencyPolicy(j.DependsOn[i].OnFailure) {
+			return 0, fmt.Errorf("%w: on_failure must be cancel, fail or ignore", ErrInvalidJob)
+		}
+	}
+
+	// jobs run immediately unless they are scheduled for a point in time
+	// or delayed by a duration
+	if j.Delay == "" {
+		return 0, nil
+	}
+	if j.RunAt != nil {
+		return 0, fmt.Errorf("%w: run_at and delay can not be used together", ErrInvalidJob)
+	}
+	delay, err := time.ParseDuration(j.Delay)
+	if err != nil || delay < 0 {
+		return 0, fmt.Errorf("%w: delay must be a non-negative duration such as 30m", ErrInvalidJob)
+	}
+	return delay, nil
+}
+
+// Enqueue validates a new job and inserts it in its own transaction. If
+// the unique key of the job is taken, the job holding it is returned
+// instead and created is false.
+func Enqueue(db *sqlx.DB, j NewJob) (job *models.Job, created bool, err error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	job, created, err = EnqueueTx(tx, j)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return job, created, nil
+}
+
+// Clone enqueues a new job with the name, type, metadata, retry settings
+// and priority of an existing one. The unique key, dependencies, batch and
+// workflow run of the original are not carried over.
+func Clone(db *sqlx.DB, id int) (*models.Job, error) {
+	original := models.Job{}
+	err := db.Get(&original, "SELECT * FROM job WHERE id = $1", id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrJobNotFound
+		}
+		return nil, fmt.Errorf("failed to query job: %w", err)
+	}
+
+	job, _, err := Enqueue(db, NewJob{
+		Name:         original.Name,
+		Type:         original.Type,
+		Metadata:     original.Metadata,
+		MaxAttempts:  &original.MaxAttempts,
+		Backoff:      &original.Backoff,
+		BackoffDelay: &original.BackoffDelay,
+		Priority:     original.Priority,
+	})
+	return job, err
+}
+
+// EnqueueTx is Enqueue within an existing transaction. Every job, whether
+// it comes from the API or from a schedule, is created through here.
+func EnqueueTx(tx *sqlx.Tx, j NewJob) (job *models.Job, created bool, err error) {
+	delay, err := j.normalize()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var uniqueKey *string
+	if j.UniqueKey != "" {
+		uniqueKey = &j.UniqueKey
+	}
+
+	state := "notstarted"
+	if len(j.DependsOn) > 0 {
+		state = "waiting"
+		err = lockParents(tx, j.DependsOn)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	query := `
+		INSERT INTO job (name, type, state, created_at, started_at, completed_at, metadata,
+			max_attempts, backoff, backoff_delay, run_at, priority, unique_key)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP, NULL, NULL, $4,
+			$5, $6, $7,
+			COALESCE(
+				CAST(CAST($8 AS TIMESTAMPTZ) AS TIMESTAMP),
+				CURRENT_TIMESTAMP + make_interval(secs => $9)
+			),
+			$10, $11)
+		RETURNING *;
+	`
+
+	job = &models.Job{}
+	err = tx.Get(job, query, j.Name, j.Type, state, j.Metadata,
+		*j.MaxAttempts, *j.Backoff, *j.BackoffDelay, j.RunAt, delay.Seconds(), j.Priority, uniqueKey)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to insert job: %w", err)
+	}
+
+	if uniqueKey != nil {
+		existing, err := claimUniqueKey(tx, job, j)
+		if err != nil {
+			return nil, false, err
+		}
+		if existing != nil {
+			return existing, false, nil
+		}
+	}
+
+	if len(j.DependsOn) > 0 {
+		err = addDependencies(tx, job, j.DependsOn)
+		if err != nil {
+			return nil, false, err
+		}
+		err = tx.Get(job, "SELECT * FROM job WHERE id = $1", job.ID)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to reload job: %w", err)
+		}
+	}
+
+	if job.State == "notstarted" {
+		err = notifyAvailable(tx, job.Type)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return job, true, nil
+}
+
+// claimUniqueKey takes the unique key of a freshly inserted job. If the key
+// is held by another job, the fresh job is deleted again and the other job
+// is returned.
+func claimUniqueKey(tx *sqlx.Tx, job *models.Job, j NewJob) (*models.Job, error) {
+	// free the key if it expired or its job has finished
+	_, err := tx.Exec(`
+		DELETE FROM job_unique_key AS k
+		USING job
+		WHERE k.key = $1 AND job.id = k.job_id AND (
+			k.expires_at <= CURRENT_TIMESTAMP
+			OR (k.expires_at IS NULL AND job.state IN ('complete', 'cancelled', 'deadletter'))
+		);
+	`, j.UniqueKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to release expired unique key: %w", err)
+	}
+
+	// keys taken while active have no expiry
+	var window *float64
+	if !j.UniqueWhileActive {
+		seconds := UniqueWindow.Seconds()
+		window = &seconds
+	}
+
+	// a concurrent insert of the same key blocks here until the other
+	// transaction ends, the primary key makes sure only one of them wins
+	var holder int
+	err = tx.Get(&holder, `
+		INSERT INTO job_unique_key (key, job_id, expires_at)
+		VALUES ($1, $2, CURRENT_TIMESTAMP + make_interval(secs => $3))
+		ON CONFLICT (key) DO NOTHING
+		RETURNING job_id;
+	`, j.UniqueKey, job.ID, window)
+	if errors.Is(err, sql.ErrNoRows) {
+		// the winner is only visible to a new statement
+		err = tx.Get(&holder, "SELECT job_id FROM job_unique_key WHERE key = $1", j.UniqueKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim unique key: %w", err)
+	}
+	if holder == job.ID {
+		return nil, nil
+	}
+
+	_, err = tx.Exec("DELETE FROM job WHERE id = $1", job.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete duplicate job: %w", err)
+	}
+
+	existing := models.Job{}
+	err = tx.Get(&existing, "SELECT * FROM job WHERE id = $1", holder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query existing job: %w", err)
+	}
+	return &existing, nil
+}
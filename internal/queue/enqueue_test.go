@@ -0,0 +1,43 @@
+package queue
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestNormalizeBounds(t *testing.T) {
+	intPtr := func(value int) *int {
+		return &value
+	}
+
+	tests := []struct {
+		name  string
+		job   NewJob
+		valid bool
+	}{
+		{"defaults", NewJob{}, true},
+		{"largest max_attempts", NewJob{MaxAttempts: intPtr(math.MaxInt32)}, true},
+		{"zero max_attempts", NewJob{MaxAttempts: intPtr(0)}, false},
+		{"max_attempts above INTEGER", NewJob{MaxAttempts: intPtr(math.MaxInt32 + 1)}, false},
+		{"largest backoff_delay", NewJob{BackoffDelay: intPtr(math.MaxInt32)}, true},
+		{"negative backoff_delay", NewJob{BackoffDelay: intPtr(-1)}, false},
+		{"backoff_delay above INTEGER", NewJob{BackoffDelay: intPtr(math.MaxInt32 + 1)}, false},
+		{"largest priority", NewJob{Priority: math.MaxInt32}, true},
+		{"smallest priority", NewJob{Priority: math.MinInt32}, true},
+		{"priority above INTEGER", NewJob{Priority: math.MaxInt32 + 1}, false},
+		{"priority below INTEGER", NewJob{Priority: math.MinInt32 - 1}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.job.normalize()
+			if test.valid && err != nil {
+				t.Errorf("normalize() = %v, want no error", err)
+			}
+			if !test.valid && !errors.Is(err, ErrInvalidJob) {
+				t.Errorf("normalize() = %v, want ErrInvalidJob", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package queue
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// EventRetention is how long job events are kept for clients resuming an
+// event stream. Zero keeps them until their job is deleted.
+var EventRetention = 7 * 24 * time.Hour
+
+func init() {
+	if value := os.Getenv("JOB_EVENT_RETENTION"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			slog.Error("JOB_EVENT_RETENTION is not a valid duration", "value", value)
+			os.Exit(1)
+		}
+		EventRetention = duration
+	}
+}
+
+// EventFilter narrows down which events a client receives. An empty filter
+// matches every event.
+type EventFilter struct {
+	// Types holds job types, either exact or glob patterns such as docker.*,
+	// matched like the types of a claim Filter
+	Types []string
+	// States holds the states a job has to enter, created events carry the
+	// state the job was created in
+	States []string
+	// JobIDs holds the jobs to follow
+	JobIDs []int
+}
+
+// Matches reports whether an event passes the filter.
+func (f EventFilter) Matches(event models.JobEvent) bool {
+	if len(f.States) > 0 && !slices.Contains(f.States, event.State) {
+		return false
+	}
+	if len(f.JobIDs) > 0 && !slices.Contains(f.JobIDs, event.JobID) {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, pattern := range f.Types {
+		if matchGlob(pattern, event.JobType) {
+			return true
+		}
+	}
+	return false
+}
+
+// EventCursor is a position in the event log. Events are read in the order
+// of the transactions that wrote them rather than by id, because ids are
+// taken before a transaction commits and a slow transaction could commit an
+// event with a lower id than one that was already read.
+type EventCursor struct {
+	TxID string `db:"txid"`
+	ID   int64  `db:"id"`
+}
+
+// eventColumns are the columns of job_event that make up a models.JobEvent,
+// plus the transaction id for the cursor.
+const eventColumns = `id, job_id, event, job_name, job_type, state, previous_state, progress, created_at,
+	CAST(txid AS TEXT) AS txid`
+
+type eventRow struct {
+	models.JobEvent
+	TxID string `db:"txid"`
+}
+
+// NewEventCursor returns the cursor right after the event with the given
+// id. Without an id, or when the event is no longer kept, it returns the
+// cursor after the latest event, so only new events are read.
+func NewEventCursor(q sqlx.Queryer, after int64) (EventCursor, error) {
+	cursor := EventCursor{}
+	if after > 0 {
+		err := sqlx.Get(q, &cursor, "SELECT CAST(txid AS TEXT) AS txid, id FROM job_event WHERE id = $1", after)
+		if err == nil {
+			return cursor, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return cursor, fmt.Errorf("failed to query event: %w", err)
+		}
+	}
+
+	err := sqlx.Get(q, &cursor, `
+		SELECT CAST(txid AS TEXT) AS txid, id FROM job_event
+		WHERE txid < pg_snapshot_xmin(pg_current_snapshot())
+		ORDER BY txid DESC, id DESC
+		LIMIT 1;
+	`)
+	if errors.Is(err, sql.ErrNoRows) {
+		return EventCursor{TxID: "0"}, nil
+	}
+	if err != nil {
+		return cursor, fmt.Errorf("failed to query latest event: %w", err)
+	}
+	return cursor, nil
+}
+
+// ReadEvents returns up to limit events after the cursor and advances it.
+// Only events of transactions older than every transaction still running
+// are read, so no event can appear before the cursor later on.
+func ReadEvents(q sqlx.Queryer, cursor *EventCursor, limit int) ([]models.JobEvent, error) {
+	rows := []eventRow{}
+	err := sqlx.Select(q, &rows, `
+		SELECT `+eventColumns+` FROM job_event
+		WHERE (txid, id) > (CAST($1 AS XID8), $2)
+			AND txid < pg_snapshot_xmin(pg_current_snapshot())
+		ORDER BY txid ASC, id ASC
+		LIMIT $3;
+	`, cursor.TxID, cursor.ID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query events: %w", err)
+	}
+
+	events := make([]models.JobEvent, len(rows))
+	for i, row := range rows {
+		events[i] = row.JobEvent
+	}
+	if len(rows) > 0 {
+		last := rows[len(rows)-1]
+		*cursor = EventCursor{TxID: last.TxID, ID: last.ID}
+	}
+	return events, nil
+}
+
+// JobEvents returns the state changes of a job in the order they happened,
+// starting with its creation. Progress events are left out, the job only
+// keeps its latest progress anyway.
+func JobEvents(q sqlx.Queryer, jobID int) ([]models.JobEvent, error) {
+	rows := []eventRow{}
+	err := sqlx.Select(q, &rows, `
+		SELECT `+eventColumns+` FROM job_event
+		WHERE job_id = $1 AND event <> 'progress'
+		ORDER BY txid ASC, id ASC;
+	`, jobID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query job events: %w", err)
+	}
+
+	events := make([]models.JobEvent, len(rows))
+	for i, row := range rows {
+		events[i] = row.JobEvent
+	}
+	return events, nil
+}
+
+// TimelineEntry is an entry on the timeline of a job, either a recorded
+// state change from From to To or, when Text is set, an entry rebuilt from
+// the timestamps and attempts of the job. From is empty for the event that
+// created the job.
+type TimelineEntry struct {
+	Time time.Time
+	From string
+	To   string
+	Text string
+}
+
+// Timeline turns the recorded events of a job into its timeline. Events
+// are only kept for the event retention, so for older jobs the timeline is
+// rebuilt from their timestamps and attempts instead, and it reports that
+// it was.
+func Timeline(job *models.Job, attempts []models.JobAttempt, events []models.JobEvent) ([]TimelineEntry, bool) {
+	timeline := []TimelineEntry{}
+	if len(events) > 0 {
+		if events[0].Event != "created" {
+			// the first events have expired already
+			timeline = append(timeline, TimelineEntry{Time: job.CreatedAt, Text: "Created"})
+		}
+		for _, event := range events {
+			entry := TimelineEntry{Time: event.CreatedAt, To: event.State}
+			if event.PreviousState != nil {
+				entry.From = *event.PreviousState
+			}
+			timeline = append(timeline, entry)
+		}
+		return timeline, false
+	}
+
+	timeline = append(timeline, TimelineEntry{Time: job.CreatedAt, Text: "Created"})
+	// attempts are ordered newest first
+	for i := len(attempts) - 1; i >= 0; i-- {
+		attempt := attempts[i]
+		text := "Attempt " + strconv.Itoa(attempt.Attempt) + " started"
+		if attempt.ClaimedBy != nil {
+			text += " by " + *attempt.ClaimedBy
+		}
+		timeline = append(timeline, TimelineEntry{Time: attempt.StartedAt, Text: text})
+		if attempt.FinishedAt != nil {
+			timeline = append(timeline, TimelineEntry{
+				Time: *attempt.FinishedAt,
+				Text: "Attempt " + strconv.Itoa(attempt.Attempt) + " ended",
+				To:   attempt.State,
+			})
+		}
+	}
+	if job.CompletedAt != nil {
+		timeline = append(timeline, TimelineEntry{Time: *job.CompletedAt, Text: "Finished", To: job.State})
+	}
+	return timeline, true
+}
+
+// EventsAdded returns a channel that is closed the next time events are
+// written on any server replica.
+func EventsAdded() <-chan struct{} {
+	return eventsAdded.wait()
+}
+
+// deleteExpiredEvents deletes events older than the event retention and
+// returns how many were deleted.
+func deleteExpiredEvents(db *sqlx.DB) (int64, error) {
+	if EventRetention == 0 {
+		return 0, nil
+	}
+
+	result, err := db.Exec(`
+		DELETE FROM job_event
+		WHERE created_at < CURRENT_TIMESTAMP - make_interval(secs => $1);
+	`, EventRetention.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired events: %w", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,167 @@
+package queue
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dusansimic/jobledger/internal/models"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"docker.build", "docker.build", true},
+		{"docker.build", "docker.push", false},
+		{"docker.*", "docker.build", true},
+		{"docker.*", "docker.", true},
+		{"docker.*", "docker", false},
+		{"*", "", true},
+		{"*", "anything at all", true},
+		{"", "", true},
+		{"", "x", false},
+		// * crosses separators like LIKE's %, unlike path.Match
+		{"build/*", "build/linux/arm64", true},
+		{"*.apply", "terraform.prod.apply", true},
+		{"*.apply", "terraform.apply.plan", false},
+		{"a*b*c", "a-b-b-c", true},
+		{"a*b*c", "a-c-b", false},
+		{"**", "x", true},
+		{"build-?", "build-1", true},
+		{"build-?", "build-", false},
+		{"build-?", "build-12", false},
+		{"?é", "éé", true},
+		// characters that are special to LIKE or path.Match match themselves
+		{"100%", "100%", true},
+		{"100%", "1000", false},
+		{"snake_case", "snake_case", true},
+		{"snake_case", "snake-case", false},
+		{"[ab]", "[ab]", true},
+		{"[ab]", "a", false},
+		{`back\slash`, `back\slash`, true},
+	}
+	for _, test := range tests {
+		if got := matchGlob(test.pattern, test.s); got != test.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", test.pattern, test.s, got, test.want)
+		}
+	}
+}
+
+func TestEventFilterMatches(t *testing.T) {
+	event := models.JobEvent{JobID: 41, JobType: "docker/build", State: "complete"}
+	tests := []struct {
+		name   string
+		filter EventFilter
+		want   bool
+	}{
+		{"empty", EventFilter{}, true},
+		{"exact type", EventFilter{Types: []string{"docker/build"}}, true},
+		{"glob type", EventFilter{Types: []string{"docker*"}}, true},
+		{"other type", EventFilter{Types: []string{"deploy", "docker/push"}}, false},
+		{"state", EventFilter{States: []string{"deadletter", "complete"}}, true},
+		{"other state", EventFilter{States: []string{"inprogress"}}, false},
+		{"job", EventFilter{JobIDs: []int{7, 41}}, true},
+		{"other job", EventFilter{JobIDs: []int{7}}, false},
+		{"all match", EventFilter{Types: []string{"*/build"}, States: []string{"complete"}, JobIDs: []int{41}}, true},
+		{"one differs", EventFilter{Types: []string{"*/build"}, States: []string{"cancelled"}, JobIDs: []int{41}}, false},
+	}
+	for _, test := range tests {
+		if got := test.filter.Matches(event); got != test.want {
+			t.Errorf("%s: Matches = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	at := func(minute int) time.Time {
+		return time.Date(2026, 1, 1, 12, minute, 0, 0, time.UTC)
+	}
+	ptr := func(v time.Time) *time.Time { return &v }
+	worker := "ci-runner#3fa9c2d17e01"
+	notstarted := "notstarted"
+	inprogress := "inprogress"
+
+	job := &models.Job{State: "complete", CreatedAt: at(0), CompletedAt: ptr(at(9))}
+	// attempts are passed newest first, like the job page queries them
+	attempts := []models.JobAttempt{
+		{Attempt: 2, ClaimedBy: &worker, State: "complete", StartedAt: at(5), FinishedAt: ptr(at(9))},
+		{Attempt: 1, State: "fail", StartedAt: at(1), FinishedAt: ptr(at(2))},
+	}
+
+	tests := []struct {
+		name     string
+		job      *models.Job
+		attempts []models.JobAttempt
+		events   []models.JobEvent
+		want     []TimelineEntry
+		rebuilt  bool
+	}{
+		{
+			name:     "recorded events",
+			job:      job,
+			attempts: attempts,
+			events: []models.JobEvent{
+				{Event: "created", State: "notstarted", CreatedAt: at(0)},
+				{Event: "state_changed", State: "inprogress", PreviousState: &notstarted, CreatedAt: at(1)},
+				{Event: "state_changed", State: "complete", PreviousState: &inprogress, CreatedAt: at(9)},
+			},
+			want: []TimelineEntry{
+				{Time: at(0), To: "notstarted"},
+				{Time: at(1), From: "notstarted", To: "inprogress"},
+				{Time: at(9), From: "inprogress", To: "complete"},
+			},
+		},
+		{
+			name:     "creation expired",
+			job:      job,
+			attempts: attempts,
+			events: []models.JobEvent{
+				{Event: "state_changed", State: "complete", PreviousState: &inprogress, CreatedAt: at(9)},
+			},
+			want: []TimelineEntry{
+				{Time: at(0), Text: "Created"},
+				{Time: at(9), From: "inprogress", To: "complete"},
+			},
+		},
+		{
+			name:     "all events expired",
+			job:      job,
+			attempts: attempts,
+			want: []TimelineEntry{
+				{Time: at(0), Text: "Created"},
+				{Time: at(1), Text: "Attempt 1 started"},
+				{Time: at(2), Text: "Attempt 1 ended", To: "fail"},
+				{Time: at(5), Text: "Attempt 2 started by " + worker},
+				{Time: at(9), Text: "Attempt 2 ended", To: "complete"},
+				{Time: at(9), Text: "Finished", To: "complete"},
+			},
+			rebuilt: true,
+		},
+		{
+			name:     "running attempt",
+			job:      &models.Job{State: "inprogress", CreatedAt: at(0)},
+			attempts: []models.JobAttempt{{Attempt: 1, ClaimedBy: &worker, State: "inprogress", StartedAt: at(1)}},
+			want: []TimelineEntry{
+				{Time: at(0), Text: "Created"},
+				{Time: at(1), Text: "Attempt 1 started by " + worker},
+			},
+			rebuilt: true,
+		},
+		{
+			name:    "never started",
+			job:     &models.Job{State: "notstarted", CreatedAt: at(0)},
+			want:    []TimelineEntry{{Time: at(0), Text: "Created"}},
+			rebuilt: true,
+		},
+	}
+
+	for _, test := range tests {
+		got, rebuilt := Timeline(test.job, test.attempts, test.events)
+		if !reflect.DeepEqual(got, test.want) || rebuilt != test.rebuilt {
+			t.Errorf("%s: Timeline = %+v, %v, want %+v, %v", test.name, got, rebuilt, test.want, test.rebuilt)
+		}
+	}
+}
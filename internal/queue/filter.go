@@ -0,0 +1,112 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Filter narrows down which jobs a worker is able to claim. An empty filter
+// matches every job.
+type Filter struct {
+	// Types holds job types a worker can run. Each entry is either an exact
+	// type such as terraform.apply or a glob pattern such as docker.*.
+	Types []string
+	// Labels holds metadata key/value pairs that a job must carry to be
+	// handed to the worker, for example arch=arm64.
+	Labels map[string]string
+}
+
+// globToLike converts a glob pattern using * and ? wildcards into an SQL
+// LIKE pattern, escaping characters that LIKE would otherwise interpret.
+func globToLike(pattern string) string {
+	var b strings.Builder
+	for _, c := range pattern {
+		switch c {
+		case '\\', '%', '_':
+			b.WriteRune('\\')
+			b.WriteRune(c)
+		case '*':
+			b.WriteRune('%')
+		case '?':
+			b.WriteRune('_')
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// matchGlob reports whether s matches a glob pattern the way globToLike
+// matches it in SQL: * matches any run of characters, including none, ?
+// matches a single character and every other character matches itself.
+func matchGlob(pattern string, s string) bool {
+	p, t := []rune(pattern), []rune(s)
+	pi, ti := 0, 0
+	// where the last * was seen and where the text was at that point, to
+	// let the * take one more character when the rest doesn't match
+	star, mark := -1, 0
+	for ti < len(t) {
+		switch {
+		case pi < len(p) && (p[pi] == '?' || p[pi] == t[ti]) && p[pi] != '*':
+			pi++
+			ti++
+		case pi < len(p) && p[pi] == '*':
+			star, mark = pi, ti
+			pi++
+		case star >= 0:
+			mark++
+			pi, ti = star+1, mark
+		default:
+			return false
+		}
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// mayMatch reports whether a job of the given type may match the filter.
+// Labels are not known without the job, so only the type is checked. An
+// empty type stands for any job.
+func (f Filter) mayMatch(jobType string) bool {
+	if jobType == "" || len(f.Types) == 0 {
+		return true
+	}
+	for _, pattern := range f.Types {
+		if matchGlob(pattern, jobType) {
+			return true
+		}
+	}
+	return false
+}
+
+// conditions returns SQL conditions for the filter. Placeholders are
+// numbered after the arguments already present in args, and the returned
+// slice holds args extended with the filter's own values.
+func (f Filter) conditions(args []any) ([]string, []any, error) {
+	conditions := []string{}
+
+	if len(f.Types) > 0 {
+		patterns := make([]string, len(f.Types))
+		for i, t := range f.Types {
+			patterns[i] = globToLike(t)
+		}
+		args = append(args, pq.Array(patterns))
+		conditions = append(conditions, fmt.Sprintf("type LIKE ANY($%d)", len(args)))
+	}
+
+	if len(f.Labels) > 0 {
+		labels, err := json.Marshal(f.Labels)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to marshal labels: %w", err)
+		}
+		args = append(args, string(labels))
+		conditions = append(conditions, fmt.Sprintf("metadata @> $%d::jsonb", len(args)))
+	}
+
+	return conditions, args, nil
+}
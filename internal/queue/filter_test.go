@@ -0,0 +1,76 @@
+package queue
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestGlobToLike(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"terraform.apply", "terraform.apply"},
+		{"docker.*", "docker.%"},
+		{"build-?", "build-_"},
+		{"*", "%"},
+		{"100%", `100\%`},
+		{"snake_case", `snake\_case`},
+		{`back\slash`, `back\\slash`},
+		{`*_%\?`, `%\_\%\\_`},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := globToLike(test.pattern); got != test.want {
+			t.Errorf("globToLike(%q) = %q, want %q", test.pattern, got, test.want)
+		}
+	}
+}
+
+func TestFilterConditions(t *testing.T) {
+	tests := []struct {
+		name       string
+		filter     Filter
+		args       []any
+		conditions []string
+		newArgs    []any
+	}{
+		{
+			name:       "empty",
+			filter:     Filter{},
+			args:       []any{"worker"},
+			conditions: []string{},
+			newArgs:    []any{"worker"},
+		},
+		{
+			name:       "types",
+			filter:     Filter{Types: []string{"docker.*", "snake_case"}},
+			args:       []any{"worker", 300},
+			conditions: []string{"type LIKE ANY($3)"},
+			newArgs:    []any{"worker", 300, pq.Array([]string{"docker.%", `snake\_case`})},
+		},
+		{
+			name:       "types and labels",
+			filter:     Filter{Types: []string{"deploy"}, Labels: map[string]string{"arch": "arm64"}},
+			args:       nil,
+			conditions: []string{"type LIKE ANY($1)", "metadata @> $2::jsonb"},
+			newArgs:    []any{pq.Array([]string{"deploy"}), `{"arch":"arm64"}`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conditions, args, err := test.filter.conditions(test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(conditions, test.conditions) {
+				t.Errorf("conditions = %q, want %q", conditions, test.conditions)
+			}
+			if !reflect.DeepEqual(args, test.newArgs) {
+				t.Errorf("args = %#v, want %#v", args, test.newArgs)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package queue
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	LEASE_EXPIRED_REQUEUE = "requeue"
+	LEASE_EXPIRED_FAIL    = "fail"
+)
+
+var (
+	// LeaseDuration is how long a worker owns a claimed job without sending
+	// a heartbeat.
+	LeaseDuration = 5 * time.Minute
+	// MaxLeaseDuration is the longest lease a worker may ask for.
+	MaxLeaseDuration = time.Hour
+	// ReaperInterval is how often the reaper looks for expired leases.
+	ReaperInterval = 30 * time.Second
+	// LeaseExpiredAction decides what happens to a job whose lease expired,
+	// it is either LEASE_EXPIRED_REQUEUE or LEASE_EXPIRED_FAIL.
+	LeaseExpiredAction = LEASE_EXPIRED_REQUEUE
+)
+
+var (
+	ErrJobNotFound  = errors.New("job not found")
+	ErrInvalidState = errors.New("job is in an invalid state for this operation")
+	// ErrNotOwner is returned when a worker reports on a job that another
+	// worker has claimed.
+	ErrNotOwner = fmt.Errorf("%w: job is claimed by another worker", ErrInvalidState)
+)
+
+func init() {
+	if value := os.Getenv("JOB_LEASE_DURATION"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			slog.Error("JOB_LEASE_DURATION is not a valid duration", "value", value)
+			os.Exit(1)
+		}
+		LeaseDuration = duration
+	}
+
+	if value := os.Getenv("JOB_MAX_LEASE_DURATION"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			slog.Error("JOB_MAX_LEASE_DURATION is not a valid duration", "value", value)
+			os.Exit(1)
+		}
+		MaxLeaseDuration = duration
+	}
+	if LeaseDuration > MaxLeaseDuration {
+		slog.Error("JOB_LEASE_DURATION is longer than JOB_MAX_LEASE_DURATION", "lease", LeaseDuration, "max", MaxLeaseDuration)
+		os.Exit(1)
+	}
+
+	if value := os.Getenv("JOB_REAPER_INTERVAL"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			slog.Error("JOB_REAPER_INTERVAL is not a valid duration", "value", value)
+			os.Exit(1)
+		}
+		ReaperInterval = duration
+	}
+
+	switch value := os.Getenv("JOB_LEASE_EXPIRED_ACTION"); value {
+	case "":
+	case LEASE_EXPIRED_REQUEUE, LEASE_EXPIRED_FAIL:
+		LeaseExpiredAction = value
+	default:
+		slog.Error("JOB_LEASE_EXPIRED_ACTION must be either requeue or fail", "value", value)
+		os.Exit(1)
+	}
+}
+
+// Heartbeat extends the lease of an in-progress job by the given duration,
+// counted from now. Only the worker that claimed the job may extend it.
+func Heartbeat(db *sqlx.DB, id string, claimedBy string, lease time.Duration) (*models.Job, error) {
+	jobID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	job := models.Job{}
+	err = db.Get(&job, `
+		UPDATE job
+		SET lease_expires_at = CURRENT_TIMESTAMP + make_interval(secs => $1)
+		WHERE id = $2 AND state = 'inprogress' AND claimed_by = $3
+		RETURNING *;
+	`, lease.Seconds(), jobID, claimedBy)
+	if err == nil {
+		return &job, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("failed to extend lease: %w", err)
+	}
+
+	// nothing was updated, find out why
+	err = db.Get(&job, "SELECT * FROM job WHERE id = $1", jobID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrJobNotFound
+		}
+		return nil, fmt.Errorf("failed to query job: %w", err)
+	}
+	err = checkTransition(&job, "heartbeat")
+	if err == nil {
+		err = checkOwner(&job, claimedBy)
+	}
+	if err == nil {
+		// the job was started again right after the update
+		err = fmt.Errorf("%w: job changed state during heartbeat", ErrInvalidState)
+	}
+	return nil, err
+}
+
+// reapExpiredLeases handles every in-progress job whose lease has run out
+// and returns the ids of the affected jobs. Requeued jobs go straight back
+// to notstarted without using up an attempt, failed jobs go through the
+// regular retry policy.
+func reapExpiredLeases(db *sqlx.DB) ([]int, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	jobs := []models.Job{}
+	err = tx.Select(&jobs, `
+		SELECT * FROM job
+		WHERE state = 'inprogress' AND lease_expires_at < CURRENT_TIMESTAMP
+		FOR UPDATE SKIP LOCKED;
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query expired leases: %w", err)
+	}
+
+	ids := make([]int, len(jobs))
+	for i := range jobs {
+		job := &jobs[i]
+		ids[i] = job.ID
+
+		if LeaseExpiredAction == LEASE_EXPIRED_FAIL {
+			err = failAttempt(tx, job, models.JobError{
+				Message: "lease expired",
+				Code:    "lease_expired",
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		reason := "lease expired"
+		err = finishAttempt(tx, job, "expired", &reason)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`
+			UPDATE job
+			SET state = 'notstarted', started_at = NULL, claimed_by = NULL, lease_expires_at = NULL,
+				attempts = attempts - 1
+			WHERE id = $1;
+		`, job.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to requeue job: %w", err)
+		}
+		err = notifyAvailable(tx, job.Type)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return ids, nil
+}
+
+// RunReaper periodically reclaims jobs whose worker stopped sending
+// heartbeats. It never returns and is meant to be started in a goroutine.
+func RunReaper(db *sqlx.DB) {
+	ticker := time.NewTicker(ReaperInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ids, err := reapExpiredLeases(db)
+		if err != nil {
+			slog.Error("Failed to reap expired leases", "reaper", "lease", "err", err)
+			continue
+		}
+		for _, id := range ids {
+			slog.Warn("Job lease expired", "reaper", "lease", "id", id, "action", LeaseExpiredAction)
+		}
+	}
+}
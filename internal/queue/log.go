@@ -0,0 +1,137 @@
+package queue
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// LogMaxBytes is how many bytes of log lines are kept per job. When a job
+// grows past it, its oldest lines are cut off.
+var LogMaxBytes int64 = 10 << 20
+
+func init() {
+	if value := os.Getenv("JOB_LOG_MAX_BYTES"); value != "" {
+		maxBytes, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || maxBytes <= 0 {
+			slog.Error("JOB_LOG_MAX_BYTES is not a valid size", "value", value)
+			os.Exit(1)
+		}
+		LogMaxBytes = maxBytes
+	}
+}
+
+// LogLine is a line of output uploaded by a worker. Lines without a time
+// are stamped with the time they were received.
+type LogLine struct {
+	Line string     `json:"line"`
+	Time *time.Time `json:"time"`
+}
+
+// AppendLog appends lines to the log of an in-progress job, numbering them
+// after the lines already stored, and cuts off the oldest lines if the log
+// outgrows LogMaxBytes. It returns the sequence number of the last line.
+func AppendLog(db *sqlx.DB, id string, lines []LogLine) (int64, error) {
+	if len(lines) == 0 {
+		return 0, nil
+	}
+
+	texts := make([]string, len(lines))
+	times := make([]string, len(lines))
+	for i, line := range lines {
+		texts[i] = line.Line
+		if line.Time != nil {
+			times[i] = line.Time.Format(time.RFC3339Nano)
+		}
+	}
+
+	var last int64
+	_, err := withJob(db, id, "log", func(tx *sqlx.Tx, job *models.Job) error {
+		// the lock on the job row keeps concurrent uploads from taking the
+		// same sequence numbers
+		err := tx.Get(&last, `
+			WITH inserted AS (
+				INSERT INTO job_log (job_id, seq, line, created_at)
+				SELECT $1,
+					(SELECT COALESCE(MAX(seq), 0) FROM job_log WHERE job_id = $1) + t.ord,
+					t.line,
+					COALESCE(CAST(CAST(NULLIF(t.stamp, '') AS TIMESTAMPTZ) AS TIMESTAMP), CURRENT_TIMESTAMP)
+				FROM unnest($2::text[], $3::text[]) WITH ORDINALITY AS t(line, stamp, ord)
+				RETURNING seq
+			)
+			SELECT MAX(seq) FROM inserted;
+		`, job.ID, pq.Array(texts), pq.Array(times))
+		if err != nil {
+			return fmt.Errorf("failed to append log: %w", err)
+		}
+
+		_, err = tx.Exec(`
+			DELETE FROM job_log
+			WHERE job_id = $1 AND seq <= (
+				SELECT seq FROM (
+					SELECT seq, SUM(octet_length(line)) OVER (ORDER BY seq DESC) AS size
+					FROM job_log
+					WHERE job_id = $1
+				) AS sized
+				WHERE size > $2
+				ORDER BY seq DESC
+				LIMIT 1
+			);
+		`, job.ID, LogMaxBytes)
+		if err != nil {
+			return fmt.Errorf("failed to cut off log: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return last, nil
+}
+
+// ReadLog returns log lines of a job with a sequence number greater than
+// after. If tail is positive only the last tail of those lines are returned.
+func ReadLog(db *sqlx.DB, id string, after int64, tail int) ([]models.JobLogLine, error) {
+	jobID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var exists bool
+	err = db.Get(&exists, "SELECT EXISTS (SELECT 1 FROM job WHERE id = $1)", jobID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query job: %w", err)
+	}
+	if !exists {
+		return nil, ErrJobNotFound
+	}
+
+	lines := []models.JobLogLine{}
+	if tail > 0 {
+		err = db.Select(&lines, `
+			SELECT * FROM (
+				SELECT * FROM job_log
+				WHERE job_id = $1 AND seq > $2
+				ORDER BY seq DESC
+				LIMIT $3
+			) AS tail
+			ORDER BY seq ASC;
+		`, jobID, after, tail)
+	} else {
+		err = db.Select(&lines, `
+			SELECT * FROM job_log
+			WHERE job_id = $1 AND seq > $2
+			ORDER BY seq ASC;
+		`, jobID, after)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query log: %w", err)
+	}
+	return lines, nil
+}
@@ -0,0 +1,239 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const (
+	// JOBS_CHANNEL is the Postgres notification channel that announces jobs
+	// becoming claimable.
+	JOBS_CHANNEL = "jobledger_jobs"
+	// EVENTS_CHANNEL is notified by the job_event trigger whenever events
+	// are written.
+	EVENTS_CHANNEL = "jobledger_events"
+)
+
+var (
+	// MaxClaimWait is the longest a claim request may wait for a job.
+	MaxClaimWait = 60 * time.Second
+	// claimPollInterval is how often a waiting claim looks for jobs on its
+	// own. It picks up jobs that become due without a notification, such as
+	// retries after their backoff delay.
+	claimPollInterval = 30 * time.Second
+)
+
+// signal wakes every goroutine waiting on it at once. Its channel is
+// closed and replaced on every wake.
+type signal struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func newSignal() *signal {
+	return &signal{ch: make(chan struct{})}
+}
+
+// wait returns the channel that is closed on the next wake.
+func (s *signal) wait() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ch
+}
+
+func (s *signal) wake() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.ch)
+	s.ch = make(chan struct{})
+}
+
+// jobWake tells a waiting claim that a job of the given type, or of any
+// type if it is empty, became claimable.
+type jobWake struct {
+	jobType string
+	// hops is how many more claims the wake may be handed on to after a
+	// claim that found nothing, so it can't go round forever
+	hops int
+}
+
+type claimWaiter struct {
+	filter Filter
+	woken  chan jobWake
+}
+
+// waitQueue holds the claims waiting in this process, longest waiting
+// first. Every notification wakes a single claim, so a new job doesn't set
+// all idle workers racing for it.
+type waitQueue struct {
+	mu      sync.Mutex
+	waiters []*claimWaiter
+}
+
+// add queues a claim. It has to be added before it looks for jobs, so a
+// job that becomes claimable in the meantime still wakes it.
+func (q *waitQueue) add(filter Filter) *claimWaiter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	waiter := &claimWaiter{filter: filter, woken: make(chan jobWake, 1)}
+	q.waiters = append(q.waiters, waiter)
+	return waiter
+}
+
+// remove takes a claim that stops waiting out of the queue. If it was woken
+// in the meantime, the wake is handed on to the next claim.
+func (q *waitQueue) remove(waiter *claimWaiter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if i := slices.Index(q.waiters, waiter); i >= 0 {
+		q.waiters = slices.Delete(q.waiters, i, i+1)
+		return
+	}
+	// wakes are sent while holding the lock, so it is already there
+	q.wakeLocked(<-waiter.woken)
+}
+
+// notify wakes the longest waiting claim that may take a job of the type.
+func (q *waitQueue) notify(jobType string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.wakeLocked(jobWake{jobType: jobType, hops: len(q.waiters)})
+}
+
+// wake hands a wake on to the next claim that may take the job.
+func (q *waitQueue) wake(wake jobWake) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.wakeLocked(wake)
+}
+
+func (q *waitQueue) wakeLocked(wake jobWake) {
+	for i, waiter := range q.waiters {
+		if waiter.filter.mayMatch(wake.jobType) {
+			q.waiters = slices.Delete(q.waiters, i, i+1)
+			waiter.woken <- wake
+			return
+		}
+	}
+}
+
+// wakeAll wakes every waiting claim.
+func (q *waitQueue) wakeAll() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, waiter := range q.waiters {
+		waiter.woken <- jobWake{}
+	}
+	q.waiters = nil
+}
+
+var (
+	// claimWaiters are the claims waiting in this process
+	claimWaiters = &waitQueue{}
+	// eventsAdded wakes event streams of this process
+	eventsAdded = newSignal()
+)
+
+// notifyAvailable tells every server replica that a job of the given type
+// became claimable. Within a transaction the notification is only sent once
+// it commits, and Postgres folds repeated ones into one.
+func notifyAvailable(e sqlx.Execer, jobType string) error {
+	_, err := e.Exec("SELECT pg_notify($1, $2)", JOBS_CHANNEL, jobType)
+	if err != nil {
+		return fmt.Errorf("failed to notify waiting workers: %w", err)
+	}
+	return nil
+}
+
+// ClaimWait is Claim that waits up to the given duration for a matching job
+// to appear when there is none right away. The wait ends early when the
+// context is cancelled, e.g. because the worker went away.
+func ClaimWait(ctx context.Context, db *sqlx.DB, filter Filter, claimedBy string, lease time.Duration, wait time.Duration) (*models.Job, error) {
+	if wait <= 0 {
+		return Claim(db, filter, claimedBy, lease)
+	}
+
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	poll := time.NewTimer(claimPollInterval)
+	defer poll.Stop()
+
+	var woken *jobWake
+	for {
+		waiter := claimWaiters.add(filter)
+
+		job, err := Claim(db, filter, claimedBy, lease)
+		if !errors.Is(err, ErrNoJob) {
+			claimWaiters.remove(waiter)
+			if err == nil && woken != nil {
+				// the notification may have been for more than one job
+				claimWaiters.wake(*woken)
+			}
+			return job, err
+		}
+		if woken != nil && woken.jobType != "" && len(filter.Labels) > 0 && woken.hops > 0 {
+			// the job may carry labels meant for another worker
+			claimWaiters.wake(jobWake{jobType: woken.jobType, hops: woken.hops - 1})
+		}
+		woken = nil
+
+		poll.Reset(claimPollInterval)
+		select {
+		case wake := <-waiter.woken:
+			woken = &wake
+		case <-poll.C:
+			claimWaiters.remove(waiter)
+		case <-deadline.C:
+			claimWaiters.remove(waiter)
+			return nil, ErrNoJob
+		case <-ctx.Done():
+			claimWaiters.remove(waiter)
+			return nil, ErrNoJob
+		}
+	}
+}
+
+// RunListener wakes waiting claims and event streams whenever any replica
+// announces new jobs or events. It never returns and is meant to be started
+// in a goroutine.
+func RunListener(listener *pq.Listener) {
+	for _, channel := range []string{JOBS_CHANNEL, EVENTS_CHANNEL} {
+		err := listener.Listen(channel)
+		if err != nil {
+			slog.Error("Failed to listen for notifications", "listener", channel, "err", err)
+			return
+		}
+	}
+
+	// make sure a dead connection gets noticed and re-established
+	ping := time.NewTicker(90 * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case notification := <-listener.Notify:
+			switch {
+			case notification == nil:
+				// the connection was re-established, anything sent in the
+				// meantime was missed, so wake everyone up
+				claimWaiters.wakeAll()
+				eventsAdded.wake()
+			case notification.Channel == JOBS_CHANNEL:
+				claimWaiters.notify(notification.Extra)
+			case notification.Channel == EVENTS_CHANNEL:
+				eventsAdded.wake()
+			}
+		case <-ping.C:
+			go listener.Ping()
+		}
+	}
+}
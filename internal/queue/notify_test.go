@@ -0,0 +1,102 @@
+package queue
+
+import "testing"
+
+// woken returns the wake a waiter received, if any.
+func woken(waiter *claimWaiter) (jobWake, bool) {
+	select {
+	case wake := <-waiter.woken:
+		return wake, true
+	default:
+		return jobWake{}, false
+	}
+}
+
+func TestWaitQueueNotifyWakesOne(t *testing.T) {
+	q := &waitQueue{}
+	first := q.add(Filter{})
+	second := q.add(Filter{})
+	third := q.add(Filter{})
+
+	q.notify("docker.build")
+	if wake, ok := woken(first); !ok || wake.jobType != "docker.build" || wake.hops != 3 {
+		t.Fatalf("first waiter got %+v, %v, want a wake for docker.build with 3 hops", wake, ok)
+	}
+	if _, ok := woken(second); ok {
+		t.Fatal("second waiter was woken by the same notification")
+	}
+
+	q.notify("deploy")
+	if _, ok := woken(second); !ok {
+		t.Fatal("second waiter was not woken by the next notification")
+	}
+	if _, ok := woken(third); ok {
+		t.Fatal("third waiter was woken too")
+	}
+}
+
+func TestWaitQueueFilters(t *testing.T) {
+	q := &waitQueue{}
+	docker := q.add(Filter{Types: []string{"docker.*"}})
+	deploy := q.add(Filter{Types: []string{"deploy"}})
+	any := q.add(Filter{})
+
+	q.notify("deploy")
+	if _, ok := woken(deploy); !ok {
+		t.Fatal("the waiter for deploy jobs was not woken")
+	}
+	if _, ok := woken(docker); ok {
+		t.Fatal("the waiter for docker jobs was woken for a deploy job")
+	}
+
+	q.notify("terraform.apply")
+	if _, ok := woken(any); !ok {
+		t.Fatal("the waiter for any job was not woken")
+	}
+
+	// nobody left who could take it
+	q.notify("terraform.apply")
+	if _, ok := woken(docker); ok {
+		t.Fatal("the waiter for docker jobs was woken for a terraform job")
+	}
+
+	// a notification without a type is for anyone
+	q.notify("")
+	if _, ok := woken(docker); !ok {
+		t.Fatal("the waiter for docker jobs was not woken for a job of any type")
+	}
+}
+
+func TestWaitQueueRemoveHandsOn(t *testing.T) {
+	q := &waitQueue{}
+	first := q.add(Filter{})
+	second := q.add(Filter{})
+
+	q.notify("x")
+	// the first claim gives up before it noticed the wake
+	q.remove(first)
+	if wake, ok := woken(second); !ok || wake.jobType != "x" {
+		t.Fatalf("second waiter got %+v, %v, want the handed on wake", wake, ok)
+	}
+
+	third := q.add(Filter{})
+	q.remove(third)
+	q.notify("y")
+	if _, ok := woken(third); ok {
+		t.Fatal("a removed waiter was woken")
+	}
+}
+
+func TestWaitQueueWakeAll(t *testing.T) {
+	q := &waitQueue{}
+	waiters := []*claimWaiter{q.add(Filter{Types: []string{"a"}}), q.add(Filter{Types: []string{"b"}})}
+	q.wakeAll()
+	for i, waiter := range waiters {
+		if _, ok := woken(waiter); !ok {
+			t.Errorf("waiter %d was not woken", i)
+		}
+	}
+	if len(q.waiters) != 0 {
+		t.Errorf("%d waiters left in the queue", len(q.waiters))
+	}
+}
@@ -0,0 +1,99 @@
+package queue
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrNoJob is returned by Claim when there is no job waiting to be picked up.
+var ErrNoJob = errors.New("no job available")
+
+// PriorityAging is how long a job has to wait to gain one priority point.
+// Aging is disabled when it is zero.
+var PriorityAging time.Duration
+
+func init() {
+	if value := os.Getenv("JOB_PRIORITY_AGING"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			slog.Error("JOB_PRIORITY_AGING is not a valid duration", "value", value)
+			os.Exit(1)
+		}
+		PriorityAging = duration
+	}
+}
+
+// Claim picks the job with the highest priority matching the filter that
+// has not been started yet and is due to run, oldest first among equal
+// priorities. It moves the job to inprogress and records who claimed it,
+// all in a single transaction. Rows locked by a concurrent claim are
+// skipped, so two workers polling at the same time never receive the same
+// job. The claimed job is leased to the worker for the given duration.
+func Claim(db *sqlx.DB, filter Filter, claimedBy string, lease time.Duration) (*models.Job, error) {
+	conditions, args, err := filter.conditions([]any{claimedBy, lease.Seconds()})
+	if err != nil {
+		return nil, err
+	}
+	conditions = append([]string{"state = 'notstarted'", "run_at <= CURRENT_TIMESTAMP"}, conditions...)
+
+	order := "priority DESC, id ASC"
+	if PriorityAging > 0 {
+		// every aging interval a job waits raises its priority by one, so
+		// low priority jobs can't be starved by a steady stream of urgent ones
+		args = append(args, PriorityAging.Seconds())
+		order = fmt.Sprintf(
+			"priority + floor(extract(epoch FROM CURRENT_TIMESTAMP - run_at) / $%d) DESC, id ASC",
+			len(args),
+		)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE job
+		SET state = 'inprogress', started_at = CURRENT_TIMESTAMP, claimed_by = $1,
+			attempts = attempts + 1, progress = NULL,
+			lease_expires_at = CURRENT_TIMESTAMP + make_interval(secs => $2)
+		WHERE id = (
+			SELECT id FROM job
+			WHERE ` + strings.Join(conditions, " AND ") + `
+			ORDER BY ` + order + `
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *;
+	`
+
+	job := models.Job{}
+	err = tx.Get(&job, query, args...)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoJob
+		}
+		return nil, fmt.Errorf("failed to claim job: %w", err)
+	}
+
+	err = startAttempt(tx, &job)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit claim: %w", err)
+	}
+
+	return &job, nil
+}
@@ -0,0 +1,78 @@
+package queue
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/dusansimic/jobledger/internal/blob"
+	"github.com/jmoiron/sqlx"
+)
+
+// RetentionPeriod is how long finished jobs are kept after they completed,
+// were cancelled or dead-lettered. Zero keeps them forever.
+var RetentionPeriod time.Duration
+
+func init() {
+	if value := os.Getenv("JOB_RETENTION"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			slog.Error("JOB_RETENTION is not a valid duration", "value", value)
+			os.Exit(1)
+		}
+		RetentionPeriod = duration
+	}
+}
+
+// deleteExpiredJobs deletes finished jobs older than the retention period
+// and returns how many were deleted. Their attempts and logs go with them,
+// their artifacts are detached and left to the sweeper.
+func deleteExpiredJobs(db *sqlx.DB) (int64, error) {
+	if RetentionPeriod == 0 {
+		return 0, nil
+	}
+
+	result, err := db.Exec(`
+		DELETE FROM job
+		WHERE id IN (
+			SELECT id FROM job
+			WHERE state IN ('complete', 'cancelled', 'deadletter')
+				AND completed_at < CURRENT_TIMESTAMP - make_interval(secs => $1)
+			LIMIT 1000
+		);
+	`, RetentionPeriod.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired jobs: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// RunRetention periodically deletes expired jobs and events and the blobs
+// of artifacts whose job is gone. It never returns and is meant to be started in a
+// goroutine.
+func RunRetention(db *sqlx.DB, store blob.BlobStore) {
+	ticker := time.NewTicker(ReaperInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		deleted, err := deleteExpiredJobs(db)
+		if err != nil {
+			slog.Error("Failed to delete expired jobs", "reaper", "retention", "err", err)
+		} else if deleted > 0 {
+			slog.Info("Deleted expired jobs", "reaper", "retention", "count", deleted)
+		}
+
+		deleted, err = deleteExpiredEvents(db)
+		if err != nil {
+			slog.Error("Failed to delete expired events", "reaper", "retention", "err", err)
+		} else if deleted > 0 {
+			slog.Info("Deleted expired events", "reaper", "retention", "count", deleted)
+		}
+
+		err = sweepArtifacts(db, store)
+		if err != nil {
+			slog.Error("Failed to sweep artifacts", "reaper", "retention", "err", err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package queue
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	BACKOFF_FIXED              = "fixed"
+	BACKOFF_EXPONENTIAL        = "exponential"
+	BACKOFF_EXPONENTIAL_JITTER = "exponential_jitter"
+)
+
+const (
+	// DefaultMaxAttempts is used when a job is created without max_attempts,
+	// so jobs are not retried unless the producer asks for it.
+	DefaultMaxAttempts = 1
+	// DefaultBackoffDelay is the base delay in seconds between attempts.
+	DefaultBackoffDelay = 10
+	// maxBackoff caps exponential backoff so a job with many attempts is
+	// still retried at least once a day.
+	maxBackoff = 24 * time.Hour
+)
+
+// ValidBackoff reports whether policy is a known backoff policy.
+func ValidBackoff(policy string) bool {
+	switch policy {
+	case BACKOFF_FIXED, BACKOFF_EXPONENTIAL, BACKOFF_EXPONENTIAL_JITTER:
+		return true
+	}
+	return false
+}
+
+// backoffDelay returns how long to wait before the next attempt after the
+// given number of attempts has failed.
+func backoffDelay(policy string, base time.Duration, attempts int) time.Duration {
+	if policy == BACKOFF_FIXED || attempts < 1 {
+		return base
+	}
+
+	delay := base
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxBackoff)
+
+	if policy == BACKOFF_EXPONENTIAL_JITTER && delay > 0 {
+		// keep at least half of the delay and randomize the rest, so workers
+		// failing together don't retry together
+		delay = delay/2 + rand.N(delay/2+1)
+	}
+
+	return delay
+}
+
+// startAttempt records the beginning of the job's current attempt. Attempts
+// are numbered after the ones already recorded rather than by the attempts
+// counter of the job, which starts over when the job is requeued.
+func startAttempt(tx *sqlx.Tx, job *models.Job) error {
+	_, err := tx.Exec(`
+		INSERT INTO job_attempt (job_id, attempt, claimed_by, started_at)
+		SELECT $1, COALESCE(MAX(attempt), 0) + 1, $2, CURRENT_TIMESTAMP
+		FROM job_attempt
+		WHERE job_id = $1;
+	`, job.ID, job.ClaimedBy)
+	if err != nil {
+		return fmt.Errorf("failed to record attempt: %w", err)
+	}
+	return nil
+}
+
+// finishAttempt records the outcome of the job's current attempt, the one
+// that hasn't finished yet. Jobs that finish without ever being started have
+// no attempt to update.
+func finishAttempt(tx *sqlx.Tx, job *models.Job, state string, reason *string) error {
+	_, err := tx.Exec(`
+		UPDATE job_attempt
+		SET state = $1, reason = $2, finished_at = CURRENT_TIMESTAMP
+		WHERE job_id = $3 AND finished_at IS NULL;
+	`, state, reason, job.ID)
+	if err != nil {
+		return fmt.Errorf("failed to finish attempt: %w", err)
+	}
+	return nil
+}
+
+// failAttempt finishes the current attempt as failed. If the job has
+// attempts left it is rescheduled according to its backoff policy,
+// otherwise it is dead-lettered.
+func failAttempt(tx *sqlx.Tx, job *models.Job, jobErr models.JobError) error {
+	err := finishAttempt(tx, job, "fail", &jobErr.Message)
+	if err != nil {
+		return err
+	}
+
+	if job.Attempts >= job.MaxAttempts {
+		return deadLetter(tx, job, jobErr)
+	}
+
+	delay := backoffDelay(job.Backoff, time.Duration(job.BackoffDelay)*time.Second, job.Attempts)
+	_, err = tx.Exec(`
+		UPDATE job
+		SET state = 'notstarted', started_at = NULL, claimed_by = NULL, lease_expires_at = NULL,
+			run_at = CURRENT_TIMESTAMP + make_interval(secs => $1),
+			last_error = $2, error = $3
+		WHERE id = $4;
+	`, delay.Seconds(), jobErr.Message, jobErr, job.ID)
+	if err != nil {
+		return fmt.Errorf("failed to reschedule job: %w", err)
+	}
+	if delay == 0 {
+		return notifyAvailable(tx, job.Type)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package queue
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		base     time.Duration
+		attempts int
+		want     time.Duration
+	}{
+		{"fixed first", BACKOFF_FIXED, 30 * time.Second, 1, 30 * time.Second},
+		{"fixed later", BACKOFF_FIXED, 30 * time.Second, 7, 30 * time.Second},
+		{"fixed above cap", BACKOFF_FIXED, 48 * time.Hour, 3, 48 * time.Hour},
+		{"exponential first", BACKOFF_EXPONENTIAL, 30 * time.Second, 1, 30 * time.Second},
+		{"exponential second", BACKOFF_EXPONENTIAL, 30 * time.Second, 2, time.Minute},
+		{"exponential fifth", BACKOFF_EXPONENTIAL, 30 * time.Second, 5, 8 * time.Minute},
+		{"exponential no attempts", BACKOFF_EXPONENTIAL, 30 * time.Second, 0, 30 * time.Second},
+		{"exponential zero base", BACKOFF_EXPONENTIAL, 0, 10, 0},
+		{"exponential capped", BACKOFF_EXPONENTIAL, 30 * time.Second, 20, maxBackoff},
+		{"exponential base above cap", BACKOFF_EXPONENTIAL, 48 * time.Hour, 2, maxBackoff},
+		{"exponential no overflow", BACKOFF_EXPONENTIAL, time.Second, math.MaxInt, maxBackoff},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := backoffDelay(test.policy, test.base, test.attempts); got != test.want {
+				t.Errorf("backoffDelay(%q, %v, %d) = %v, want %v", test.policy, test.base, test.attempts, got, test.want)
+			}
+		})
+	}
+}
+
+func TestBackoffDelayJitter(t *testing.T) {
+	tests := []struct {
+		base     time.Duration
+		attempts int
+		max      time.Duration
+	}{
+		{30 * time.Second, 1, 30 * time.Second},
+		{30 * time.Second, 3, 2 * time.Minute},
+		{30 * time.Second, 40, maxBackoff},
+	}
+	for _, test := range tests {
+		for range 100 {
+			got := backoffDelay(BACKOFF_EXPONENTIAL_JITTER, test.base, test.attempts)
+			if got < test.max/2 || got > test.max {
+				t.Fatalf("backoffDelay(jitter, %v, %d) = %v, want between %v and %v", test.base, test.attempts, got, test.max/2, test.max)
+			}
+		}
+	}
+	if got := backoffDelay(BACKOFF_EXPONENTIAL_JITTER, 0, 3); got != 0 {
+		t.Errorf("backoffDelay(jitter, 0, 3) = %v, want 0", got)
+	}
+}
@@ -0,0 +1,261 @@
+package queue
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrJobCancelled is returned when a worker reports on a job that has been
+// cancelled in the meantime. The worker is expected to abort the job.
+var ErrJobCancelled = errors.New("job cancelled")
+
+// transitions is the job state machine. For every operation it lists the
+// states a job has to be in for the operation to be allowed. Finished jobs
+// accept no operation from workers, so a buggy worker can't overwrite them.
+var transitions = map[string][]string{
+	"start":     {"notstarted"},
+	"complete":  {"inprogress"},
+	"fail":      {"inprogress"},
+	"reject":    {"inprogress"},
+	"cancel":    {"waiting", "notstarted", "inprogress"},
+	"heartbeat": {"inprogress"},
+	"progress":  {"inprogress"},
+	"log":       {"inprogress"},
+	"artifact":  {"inprogress"},
+	"requeue":   {"deadletter"},
+	"discard":   {"deadletter"},
+}
+
+// Allowed reports whether the operation is allowed on a job in the state.
+func Allowed(operation string, state string) bool {
+	return slices.Contains(transitions[operation], state)
+}
+
+// checkTransition returns an error if the operation is not allowed in the
+// job's current state.
+func checkTransition(job *models.Job, operation string) error {
+	if Allowed(operation, job.State) {
+		return nil
+	}
+	if job.State == "cancelled" {
+		return ErrJobCancelled
+	}
+	return fmt.Errorf("%w: can not %s a job in state %s", ErrInvalidState, operation, job.State)
+}
+
+// checkOwner returns ErrNotOwner if the job was claimed by another worker
+// than the one reporting on it.
+func checkOwner(job *models.Job, claimedBy string) error {
+	if job.ClaimedBy == nil || *job.ClaimedBy != claimedBy {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+// parseID converts a job id taken from a URL, ids that are not a number
+// can't belong to any job.
+func parseID(id string) (int, error) {
+	parsed, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, ErrJobNotFound
+	}
+	return parsed, nil
+}
+
+// lockJob loads a job and locks its row until the transaction ends.
+func lockJob(tx *sqlx.Tx, id string) (*models.Job, error) {
+	jobID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	job := models.Job{}
+	err = tx.Get(&job, "SELECT * FROM job WHERE id = $1 FOR UPDATE", jobID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrJobNotFound
+		}
+		return nil, fmt.Errorf("failed to lock job: %w", err)
+	}
+	return &job, nil
+}
+
+// jobFinished runs everything that waits for a job to reach a terminal
+// state. It is called in the transaction that finished the job.
+func jobFinished(tx *sqlx.Tx, job *models.Job) error {
+	err := releaseChildren(tx, job)
+	if err != nil {
+		return err
+	}
+	if job.BatchID != nil {
+		return checkBatch(tx, *job.BatchID)
+	}
+	return nil
+}
+
+// Get returns a job by its id.
+func Get(db *sqlx.DB, id string) (*models.Job, error) {
+	jobID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	job := models.Job{}
+	err = db.Get(&job, "SELECT * FROM job WHERE id = $1", jobID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrJobNotFound
+		}
+		return nil, fmt.Errorf("failed to query job: %w", err)
+	}
+	return &job, nil
+}
+
+// withJob runs an operation in a transaction holding the lock on the job,
+// after checking that the operation is allowed in the job's current state.
+// It returns the job as it is after the operation.
+func withJob(db *sqlx.DB, id string, operation string, fn func(tx *sqlx.Tx, job *models.Job) error) (*models.Job, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	job, err := lockJob(tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkTransition(job, operation)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fn(tx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := models.Job{}
+	err = tx.Get(&updated, "SELECT * FROM job WHERE id = $1", job.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reload job: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &updated, nil
+}
+
+// withClaimedJob is withJob for operations of the worker that claimed the
+// job. Other workers get ErrNotOwner.
+func withClaimedJob(db *sqlx.DB, id string, operation string, claimedBy string, fn func(tx *sqlx.Tx, job *models.Job) error) (*models.Job, error) {
+	return withJob(db, id, operation, func(tx *sqlx.Tx, job *models.Job) error {
+		err := checkOwner(job, claimedBy)
+		if err != nil {
+			return err
+		}
+		return fn(tx, job)
+	})
+}
+
+// Start marks a job as started by the given worker and opens a new attempt.
+// Claimed jobs are in progress already, starting one from the worker that
+// claimed it returns the job unchanged, so workers that still start the jobs
+// they claim keep working.
+func Start(db *sqlx.DB, id string, claimedBy string) (*models.Job, error) {
+	job, err := Get(db, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.State == "inprogress" && checkOwner(job, claimedBy) == nil {
+		return job, nil
+	}
+
+	return withJob(db, id, "start", func(tx *sqlx.Tx, job *models.Job) error {
+		err := tx.Get(job, `
+			UPDATE job
+			SET state = 'inprogress', started_at = CURRENT_TIMESTAMP, claimed_by = $1,
+				attempts = attempts + 1, progress = NULL,
+				lease_expires_at = CURRENT_TIMESTAMP + make_interval(secs => $2)
+			WHERE id = $3
+			RETURNING *;
+		`, claimedBy, LeaseDuration.Seconds(), job.ID)
+		if err != nil {
+			return fmt.Errorf("failed to start job: %w", err)
+		}
+		return startAttempt(tx, job)
+	})
+}
+
+// Complete marks a job and its current attempt as complete and stores the
+// result reported by the worker.
+func Complete(db *sqlx.DB, id string, claimedBy string, result models.JSONValue) (*models.Job, error) {
+	return withClaimedJob(db, id, "complete", claimedBy, func(tx *sqlx.Tx, job *models.Job) error {
+		err := finishAttempt(tx, job, "complete", nil)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			UPDATE job
+			SET state = 'complete', completed_at = CURRENT_TIMESTAMP, lease_expires_at = NULL,
+				result = $1
+			WHERE id = $2;
+		`, result, job.ID)
+		if err != nil {
+			return fmt.Errorf("failed to complete job: %w", err)
+		}
+		return jobFinished(tx, job)
+	})
+}
+
+// Fail marks the current attempt of a job as failed and stores the error
+// reported by the worker. The job is retried if it has attempts left.
+func Fail(db *sqlx.DB, id string, claimedBy string, jobErr models.JobError) (*models.Job, error) {
+	return withClaimedJob(db, id, "fail", claimedBy, func(tx *sqlx.Tx, job *models.Job) error {
+		return failAttempt(tx, job, jobErr)
+	})
+}
+
+// Cancel stops a job that has not finished yet. A job that is in progress
+// is cancelled right away, its worker finds out on its next heartbeat or
+// state update and is expected to abort.
+func Cancel(db *sqlx.DB, id string) (*models.Job, error) {
+	return withJob(db, id, "cancel", func(tx *sqlx.Tx, job *models.Job) error {
+		err := finishAttempt(tx, job, "cancelled", nil)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			UPDATE job
+			SET state = 'cancelled', completed_at = CURRENT_TIMESTAMP, lease_expires_at = NULL
+			WHERE id = $1;
+		`, job.ID)
+		if err != nil {
+			return fmt.Errorf("failed to cancel job: %w", err)
+		}
+		return jobFinished(tx, job)
+	})
+}
+
+// ReportProgress replaces the progress of an in-progress job with the
+// latest one reported by its worker.
+func ReportProgress(db *sqlx.DB, id string, claimedBy string, progress models.JobProgress) (*models.Job, error) {
+	return withClaimedJob(db, id, "progress", claimedBy, func(tx *sqlx.Tx, job *models.Job) error {
+		_, err := tx.Exec("UPDATE job SET progress = $1 WHERE id = $2", progress, job.ID)
+		if err != nil {
+			return fmt.Errorf("failed to report progress: %w", err)
+		}
+		return nil
+	})
+}
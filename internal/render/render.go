@@ -0,0 +1,51 @@
+package render
+
+import (
+	"bytes"
+	"text/template"
+)
+
+// String renders a text/template with the given data. Referencing a key
+// that the data doesn't have is an error.
+func String(text string, data any) (string, error) {
+	tmpl, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Value renders every string found in a metadata value.
+func Value(value any, data any) (any, error) {
+	switch v := value.(type) {
+	case string:
+		return String(v, data)
+	case map[string]any:
+		rendered := make(map[string]any, len(v))
+		for key, item := range v {
+			r, err := Value(item, data)
+			if err != nil {
+				return nil, err
+			}
+			rendered[key] = r
+		}
+		return rendered, nil
+	case []any:
+		rendered := make([]any, len(v))
+		for i, item := range v {
+			r, err := Value(item, data)
+			if err != nil {
+				return nil, err
+			}
+			rendered[i] = r
+		}
+		return rendered, nil
+	default:
+		return v, nil
+	}
+}
@@ -0,0 +1,76 @@
+package render
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	data := map[string]any{
+		"inputs": map[string]any{"env": "prod", "count": 3},
+		"name":   "deploy",
+	}
+
+	tests := []struct {
+		text  string
+		want  string
+		valid bool
+	}{
+		{"plain text", "plain text", true},
+		{"", "", true},
+		{"{{ .name }} to {{ .inputs.env }}", "deploy to prod", true},
+		{"{{ .inputs.count }} replicas", "3 replicas", true},
+		{`{{ printf "%03d" .inputs.count }}`, "003", true},
+		// a missing key is an error instead of "<no value>"
+		{"{{ .missing }}", "", false},
+		{"{{ .inputs.missing }}", "", false},
+		{"{{ .name ", "", false},
+		{"{{ .name.field }}", "", false},
+	}
+
+	for _, test := range tests {
+		got, err := String(test.text, data)
+		if (err == nil) != test.valid {
+			t.Errorf("String(%q) = %q, %v, want valid %v", test.text, got, err, test.valid)
+			continue
+		}
+		if test.valid && got != test.want {
+			t.Errorf("String(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestValue(t *testing.T) {
+	data := map[string]any{"env": "prod"}
+
+	value := map[string]any{
+		"target":  "{{ .env }}",
+		"count":   2.0,
+		"enabled": true,
+		"none":    nil,
+		"hosts":   []any{"web.{{ .env }}", map[string]any{"db": "db.{{ .env }}"}, 1.0},
+	}
+	want := map[string]any{
+		"target":  "prod",
+		"count":   2.0,
+		"enabled": true,
+		"none":    nil,
+		"hosts":   []any{"web.prod", map[string]any{"db": "db.prod"}, 1.0},
+	}
+
+	got, err := Value(value, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Value = %v, want %v", got, want)
+	}
+	if value["target"] != "{{ .env }}" {
+		t.Errorf("Value changed its input to %v", value)
+	}
+
+	_, err = Value(map[string]any{"deep": []any{map[string]any{"x": "{{ .missing }}"}}}, data)
+	if err == nil {
+		t.Error("Value of a nested missing key succeeded, want an error")
+	}
+}
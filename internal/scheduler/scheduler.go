@@ -0,0 +1,218 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/dusansimic/jobledger/internal/queue"
+	"github.com/dusansimic/jobledger/internal/render"
+	"github.com/jmoiron/sqlx"
+	"github.com/robfig/cron/v3"
+)
+
+// advisoryLockKey identifies the scheduler's Postgres advisory lock. Only
+// the replica holding it fires schedules on a given tick.
+const advisoryLockKey = 0x6a6f627363686564
+
+// Interval is how often the scheduler checks for due schedules.
+var Interval = 15 * time.Second
+
+func init() {
+	if value := os.Getenv("SCHEDULER_INTERVAL"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			slog.Error("SCHEDULER_INTERVAL is not a valid duration", "value", value)
+			os.Exit(1)
+		}
+		Interval = duration
+	}
+}
+
+// NextRun parses a cron expression in the given time zone and returns the
+// first time it fires after from. Standard five field expressions and
+// descriptors such as @daily are supported.
+//
+// The fields of the expression are wall clock times. A time skipped when
+// the clocks go forward fires right after the gap instead of not at all,
+// and a time that happens twice when the clocks go back fires only once.
+func NextRun(expression string, timezone string, from time.Time) (time.Time, error) {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time zone %q: %w", timezone, err)
+	}
+
+	schedule, err := cron.ParseStandard(expression)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid cron expression %q: %w", expression, err)
+	}
+
+	// the schedule is evaluated in UTC, which has no daylight saving time,
+	// on the wall clock of the time zone
+	wall := wallClock(from.In(location), time.UTC)
+	for {
+		wall = schedule.Next(wall)
+		if wall.IsZero() {
+			return time.Time{}, fmt.Errorf("cron expression %q never fires", expression)
+		}
+		// a wall clock time that happens twice may have passed already
+		next := wallClock(wall, location)
+		if next.After(from) {
+			return next, nil
+		}
+	}
+}
+
+// wallClock returns the time showing the same wall clock as t in location.
+func wallClock(t time.Time, location *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), location)
+}
+
+// TemplateData is available to the name and metadata templates of a
+// schedule, e.g. {{ .Time.Format "2006-01-02" }}.
+type TemplateData struct {
+	Time     time.Time
+	Schedule string
+}
+
+// ValidateTemplates checks that the name and metadata of a schedule render.
+func ValidateTemplates(name string, metadata models.MetadataMap) error {
+	_, err := newJob(&models.Schedule{Name: name, Metadata: metadata}, time.Now())
+	return err
+}
+
+// newJob renders the job a schedule enqueues when it fires at the given time.
+func newJob(schedule *models.Schedule, firedAt time.Time) (queue.NewJob, error) {
+	data := TemplateData{
+		Time:     firedAt,
+		Schedule: schedule.Name,
+	}
+
+	name, err := render.String(schedule.Name, data)
+	if err != nil {
+		return queue.NewJob{}, fmt.Errorf("failed to render name: %w", err)
+	}
+
+	var metadata models.MetadataMap
+	if schedule.Metadata != nil {
+		rendered, err := render.Value(map[string]any(schedule.Metadata), data)
+		if err != nil {
+			return queue.NewJob{}, fmt.Errorf("failed to render metadata: %w", err)
+		}
+		metadata = rendered.(map[string]any)
+	}
+
+	return queue.NewJob{
+		Name:     name,
+		Type:     schedule.Type,
+		Metadata: metadata,
+	}, nil
+}
+
+// fire enqueues the job of a due schedule. A schedule whose templates do
+// not produce a valid job is skipped for this run.
+func fire(tx *sqlx.Tx, schedule *models.Schedule) error {
+	location, _ := time.LoadLocation(schedule.Timezone)
+	job, err := newJob(schedule, schedule.NextRunAt.In(location))
+	if err != nil {
+		slog.Error("Failed to render scheduled job", "scheduler", "cron", "id", schedule.ID, "err", err)
+		return nil
+	}
+
+	created, _, err := queue.EnqueueTx(tx, job)
+	if err != nil {
+		if errors.Is(err, queue.ErrInvalidJob) {
+			slog.Error("Scheduled job is invalid", "scheduler", "cron", "id", schedule.ID, "err", err)
+			return nil
+		}
+		return fmt.Errorf("failed to enqueue scheduled job: %w", err)
+	}
+
+	slog.Info("Enqueued scheduled job", "scheduler", "cron", "id", schedule.ID, "job", created.ID)
+	return nil
+}
+
+// tick enqueues a job for every schedule that is due and moves the
+// schedules to their next run. Missed runs, e.g. while the server was down,
+// are not made up for, a due schedule fires once.
+func tick(db *sqlx.DB) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// the lock is released when the transaction ends, by then the schedules
+	// that fired already point to their next run
+	var locked bool
+	err = tx.Get(&locked, "SELECT pg_try_advisory_xact_lock($1)", advisoryLockKey)
+	if err != nil {
+		return fmt.Errorf("failed to acquire advisory lock: %w", err)
+	}
+	if !locked {
+		return nil
+	}
+
+	schedules := []models.Schedule{}
+	err = tx.Select(&schedules, `
+		SELECT * FROM schedule
+		WHERE NOT paused AND next_run_at <= CURRENT_TIMESTAMP
+		FOR UPDATE;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to query due schedules: %w", err)
+	}
+
+	now := time.Now()
+	for i := range schedules {
+		schedule := &schedules[i]
+
+		nextRun, err := NextRun(schedule.Cron, schedule.Timezone, now)
+		if err != nil {
+			// keep the broken schedule from firing until someone fixes it
+			slog.Error("Failed to compute next run, pausing schedule", "scheduler", "cron", "id", schedule.ID, "err", err)
+			_, err = tx.Exec("UPDATE schedule SET paused = TRUE WHERE id = $1", schedule.ID)
+			if err != nil {
+				return fmt.Errorf("failed to pause schedule: %w", err)
+			}
+			continue
+		}
+
+		err = fire(tx, schedule)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			UPDATE schedule
+			SET last_run_at = next_run_at, next_run_at = $1
+			WHERE id = $2;
+		`, nextRun, schedule.ID)
+		if err != nil {
+			return fmt.Errorf("failed to advance schedule: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// Run fires due schedules on every tick. It never returns and is meant to
+// be started in a goroutine. It is safe to run on every server replica.
+func Run(db *sqlx.DB) {
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := tick(db)
+		if err != nil {
+			slog.Error("Failed to run scheduler", "scheduler", "cron", "err", err)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dusansimic/jobledger/internal/models"
+)
+
+func TestNextRun(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		expression string
+		timezone   string
+		from       time.Time
+		want       time.Time
+	}{
+		{
+			name:       "later the same day",
+			expression: "30 2 * * *",
+			timezone:   "UTC",
+			from:       time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+			want:       time.Date(2026, 1, 1, 2, 30, 0, 0, time.UTC),
+		},
+		{
+			name:       "the run at from has passed",
+			expression: "30 2 * * *",
+			timezone:   "UTC",
+			from:       time.Date(2026, 1, 1, 2, 30, 0, 0, time.UTC),
+			want:       time.Date(2026, 1, 2, 2, 30, 0, 0, time.UTC),
+		},
+		{
+			name:       "descriptor",
+			expression: "@daily",
+			timezone:   "UTC",
+			from:       time.Date(2026, 12, 31, 23, 59, 0, 0, time.UTC),
+			want:       time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:       "months without the day are skipped",
+			expression: "0 0 31 * *",
+			timezone:   "UTC",
+			from:       time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC),
+			want:       time.Date(2026, 3, 31, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:       "midnight in the time zone",
+			expression: "0 0 * * *",
+			timezone:   "America/New_York",
+			from:       time.Date(2026, 1, 1, 3, 0, 0, 0, time.UTC),
+			want:       time.Date(2026, 1, 1, 0, 0, 0, 0, newYork),
+		},
+		{
+			name:       "clocks going forward skip the time",
+			expression: "30 2 * * *",
+			timezone:   "Europe/Berlin",
+			from:       time.Date(2026, 3, 28, 12, 0, 0, 0, berlin),
+			want:       time.Date(2026, 3, 29, 3, 30, 0, 0, berlin),
+		},
+		{
+			name:       "the day after clocks went forward",
+			expression: "30 2 * * *",
+			timezone:   "Europe/Berlin",
+			from:       time.Date(2026, 3, 29, 3, 30, 0, 0, berlin),
+			want:       time.Date(2026, 3, 30, 2, 30, 0, 0, berlin),
+		},
+		{
+			name:       "clocks going back repeat the time",
+			expression: "30 2 * * *",
+			timezone:   "Europe/Berlin",
+			from:       time.Date(2026, 10, 24, 12, 0, 0, 0, berlin),
+			want:       time.Date(2026, 10, 25, 1, 30, 0, 0, time.UTC),
+		},
+		{
+			name:       "a repeated time fires once",
+			expression: "30 2 * * *",
+			timezone:   "Europe/Berlin",
+			from:       time.Date(2026, 10, 25, 1, 30, 0, 0, time.UTC),
+			want:       time.Date(2026, 10, 26, 2, 30, 0, 0, berlin),
+		},
+		{
+			name:       "from in the first of the repeated hours",
+			expression: "45 2 * * *",
+			timezone:   "Europe/Berlin",
+			// 02:50 before the clocks go back
+			from: time.Date(2026, 10, 25, 0, 50, 0, 0, time.UTC),
+			want: time.Date(2026, 10, 26, 2, 45, 0, 0, berlin),
+		},
+	}
+
+	for _, test := range tests {
+		got, err := NextRun(test.expression, test.timezone, test.from)
+		if err != nil {
+			t.Errorf("%s: NextRun(%q, %q, %v): %v", test.name, test.expression, test.timezone, test.from, err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("%s: NextRun(%q, %q, %v) = %v, want %v", test.name, test.expression, test.timezone, test.from, got, test.want)
+		}
+	}
+}
+
+func TestNextRunInvalid(t *testing.T) {
+	tests := []struct {
+		expression string
+		timezone   string
+	}{
+		{"0 0 * * *", "Mars/Olympus_Mons"},
+		{"not a cron expression", "UTC"},
+		{"0 0 * * * *", "UTC"},
+		{"60 0 * * *", "UTC"},
+		// February never has 30 days
+		{"0 0 30 2 *", "UTC"},
+	}
+
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		got, err := NextRun(test.expression, test.timezone, from)
+		if err == nil {
+			t.Errorf("NextRun(%q, %q) = %v, want an error", test.expression, test.timezone, got)
+		}
+	}
+}
+
+func TestNewJob(t *testing.T) {
+	firedAt := time.Date(2026, 3, 1, 6, 0, 0, 0, time.UTC)
+	schedule := &models.Schedule{
+		Name: `report {{ .Time.Format "2006-01-02" }}`,
+		Type: "report.daily",
+		Metadata: models.MetadataMap{
+			"schedule": "{{ .Schedule }}",
+			"period":   map[string]any{"day": `{{ .Time.Format "02" }}`},
+			"formats":  []any{"pdf", "{{ .Time.Year }}"},
+			"copies":   2.0,
+		},
+	}
+
+	job, err := newJob(schedule, firedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Name != "report 2026-03-01" || job.Type != "report.daily" {
+		t.Errorf("job = %q of type %q, want %q of type %q", job.Name, job.Type, "report 2026-03-01", "report.daily")
+	}
+	want := models.MetadataMap{
+		"schedule": `report {{ .Time.Format "2006-01-02" }}`,
+		"period":   map[string]any{"day": "01"},
+		"formats":  []any{"pdf", "2026"},
+		"copies":   2.0,
+	}
+	if !reflect.DeepEqual(job.Metadata, want) {
+		t.Errorf("metadata = %v, want %v", job.Metadata, want)
+	}
+}
+
+func TestValidateTemplates(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata models.MetadataMap
+		valid    bool
+	}{
+		{"nightly", nil, true},
+		{"nightly {{ .Time.Weekday }}", models.MetadataMap{"by": "{{ .Schedule }}"}, true},
+		{"nightly {{ .Time.Weekday", nil, false},
+		{"nightly {{ .Missing }}", nil, false},
+		{"nightly", models.MetadataMap{"nested": []any{"{{ .Missing }}"}}, false},
+	}
+
+	for _, test := range tests {
+		err := ValidateTemplates(test.name, test.metadata)
+		if (err == nil) != test.valid {
+			t.Errorf("ValidateTemplates(%q, %v) = %v, want valid %v", test.name, test.metadata, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// Package signature signs the requests the ledger sends to webhooks and
+// batch callbacks, so receivers can check where they came from.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Header is the request header holding the signature.
+const Header = "X-Jobledger-Signature"
+
+// NewSecret returns a random secret for signing payloads.
+func NewSecret() (string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// Sign returns the signature of a payload sent at the given time. It is the
+// hex encoded HMAC-SHA256, keyed with the secret, of the unix time, a dot
+// and the body, so receivers can reject payloads replayed later.
+func Sign(secret string, sentAt time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(sentAt.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
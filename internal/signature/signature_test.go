@@ -0,0 +1,42 @@
+package signature
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"event":"job.created"}`)
+	sentAt := time.Unix(1748747529, 0)
+
+	got := Sign("whsec", sentAt, body)
+	want := "t=1748747529,sha256=601dfb97ab87fffe746b4652d485022047ab5c78c5ae44f9333aa7752762c7bd"
+	if got != want {
+		t.Errorf("Sign = %q, want %q", got, want)
+	}
+
+	// the timestamp is part of what is signed, a replay can't just update it
+	_, signature, _ := strings.Cut(got, ",")
+	_, later, _ := strings.Cut(Sign("whsec", sentAt.Add(time.Hour), body), ",")
+	if later == signature {
+		t.Error("signatures at different times are the same")
+	}
+	if other := Sign("other", sentAt, body); other == got {
+		t.Error("signatures with different secrets are the same")
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	first, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 64 || first == second {
+		t.Errorf("NewSecret = %q, %q, want two different 32 byte hex secrets", first, second)
+	}
+}
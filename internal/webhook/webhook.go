@@ -0,0 +1,561 @@
+package webhook
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/dusansimic/jobledger/internal/queue"
+	"github.com/dusansimic/jobledger/internal/signature"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const (
+	DELIVERY_PENDING   = "pending"
+	DELIVERY_DELIVERED = "delivered"
+	DELIVERY_FAILED    = "failed"
+)
+
+const (
+	// interval is how often the dispatcher runs without being woken by new
+	// events, it also sends retries that became due
+	interval = 5 * time.Second
+	// eventBatchSize is how many events are dispatched in one transaction
+	eventBatchSize = 500
+	// sendBatchSize is how many deliveries are claimed at once
+	sendBatchSize = 10
+	// timeout is how long a webhook has to respond
+	timeout = 10 * time.Second
+	// claimTimeout is how long claimed deliveries are kept from other
+	// replicas, it has to cover sending all of them one after another
+	claimTimeout = sendBatchSize*timeout + time.Minute
+	// maxAttempts is how many times a delivery is tried
+	maxAttempts = 8
+	// backoff is the delay before the first retry of a delivery, it doubles
+	// with every further attempt
+	backoff = 10 * time.Second
+	// maxResponseBytes is how much of a failed response is kept as its error
+	maxResponseBytes = 512
+)
+
+var (
+	ErrWebhookNotFound  = errors.New("webhook not found")
+	ErrDeliveryNotFound = errors.New("delivery not found")
+	ErrInvalidWebhook   = errors.New("invalid webhook")
+)
+
+var client = &http.Client{Timeout: timeout}
+
+// Create adds a webhook. A secret is generated when none is given.
+func Create(db *sqlx.DB, webhook models.Webhook) (*models.Webhook, error) {
+	target, err := url.Parse(webhook.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("%w: url must be an http or https url", ErrInvalidWebhook)
+	}
+	for _, state := range webhook.States {
+		if !validState(state) {
+			return nil, fmt.Errorf("%w: unknown state %q", ErrInvalidWebhook, state)
+		}
+	}
+	if webhook.Secret == "" {
+		webhook.Secret, err = signature.NewSecret()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if webhook.Types == nil {
+		webhook.Types = pq.StringArray{}
+	}
+	if webhook.States == nil {
+		webhook.States = pq.StringArray{}
+	}
+
+	created := models.Webhook{}
+	err = db.Get(&created, `
+		INSERT INTO webhook (url, secret, types, states)
+		VALUES ($1, $2, $3, $4)
+		RETURNING *;
+	`, webhook.URL, webhook.Secret, webhook.Types, webhook.States)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert webhook: %w", err)
+	}
+	return &created, nil
+}
+
+func validState(state string) bool {
+	switch state {
+	case "waiting", "notstarted", "inprogress", "complete", "cancelled", "deadletter":
+		return true
+	}
+	return false
+}
+
+// parseID converts an id taken from a URL, ids that are not a number can't
+// belong to anything.
+func parseID(id string, notFound error) (int, error) {
+	parsed, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, notFound
+	}
+	return parsed, nil
+}
+
+// Get returns a webhook by its id.
+func Get(db *sqlx.DB, id string) (*models.Webhook, error) {
+	webhookID, err := parseID(id, ErrWebhookNotFound)
+	if err != nil {
+		return nil, err
+	}
+
+	webhook := models.Webhook{}
+	err = db.Get(&webhook, "SELECT * FROM webhook WHERE id = $1", webhookID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrWebhookNotFound
+		}
+		return nil, fmt.Errorf("failed to query webhook: %w", err)
+	}
+	return &webhook, nil
+}
+
+// List returns all webhooks.
+func List(db *sqlx.DB) ([]models.Webhook, error) {
+	webhooks := []models.Webhook{}
+	err := db.Select(&webhooks, "SELECT * FROM webhook ORDER BY id ASC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhooks: %w", err)
+	}
+	return webhooks, nil
+}
+
+// SetPaused pauses or resumes a webhook. Events that happen while a webhook
+// is paused are not sent to it later.
+func SetPaused(db *sqlx.DB, id string, paused bool) error {
+	webhookID, err := parseID(id, ErrWebhookNotFound)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec("UPDATE webhook SET paused = $1 WHERE id = $2", paused, webhookID)
+	if err != nil {
+		return fmt.Errorf("failed to update webhook: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// Delete deletes a webhook together with its deliveries.
+func Delete(db *sqlx.DB, id string) error {
+	webhookID, err := parseID(id, ErrWebhookNotFound)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec("DELETE FROM webhook WHERE id = $1", webhookID)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// Deliveries returns the latest deliveries of a webhook, newest first.
+func Deliveries(db *sqlx.DB, webhookID int, limit int, offset int) ([]models.WebhookDelivery, error) {
+	deliveries := []models.WebhookDelivery{}
+	err := db.Select(&deliveries, `
+		SELECT * FROM webhook_delivery
+		WHERE webhook_id = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3;
+	`, webhookID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// Attempts returns the attempts of the given deliveries, oldest first.
+func Attempts(db *sqlx.DB, deliveryIDs []int64) ([]models.WebhookAttempt, error) {
+	attempts := []models.WebhookAttempt{}
+	err := db.Select(&attempts, `
+		SELECT * FROM webhook_attempt
+		WHERE delivery_id = ANY($1)
+		ORDER BY id ASC;
+	`, pq.Array(deliveryIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query delivery attempts: %w", err)
+	}
+	return attempts, nil
+}
+
+// Redeliver sends a delivery of a webhook again, with a fresh set of
+// attempts.
+func Redeliver(db *sqlx.DB, webhookID string, deliveryID string) error {
+	parsedWebhookID, err := parseID(webhookID, ErrDeliveryNotFound)
+	if err != nil {
+		return err
+	}
+	parsedDeliveryID, err := parseID(deliveryID, ErrDeliveryNotFound)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec(`
+		UPDATE webhook_delivery
+		SET state = 'pending', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND webhook_id = $2 AND state <> 'pending';
+	`, parsedDeliveryID, parsedWebhookID)
+	if err != nil {
+		return fmt.Errorf("failed to redeliver: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrDeliveryNotFound
+	}
+	return nil
+}
+
+// initCursor points the dispatcher at the end of the event log, unless it
+// already has a position. Events from before the first start are not sent.
+func initCursor(db *sqlx.DB) error {
+	cursor, err := queue.NewEventCursor(db, 0)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		INSERT INTO webhook_cursor (txid, event_id)
+		VALUES (CAST($1 AS XID8), $2)
+		ON CONFLICT DO NOTHING;
+	`, cursor.TxID, cursor.ID)
+	if err != nil {
+		return fmt.Errorf("failed to initialize webhook cursor: %w", err)
+	}
+	return nil
+}
+
+// newPayload returns the body sent to webhooks for an event.
+func newPayload(event models.JobEvent) ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"event":    "job." + event.Event,
+		"event_id": event.ID,
+		"time":     event.CreatedAt,
+		"job": map[string]any{
+			"id":             event.JobID,
+			"name":           event.JobName,
+			"type":           event.JobType,
+			"state":          event.State,
+			"previous_state": event.PreviousState,
+		},
+	})
+}
+
+// dispatch reads the next events from the event log and queues a delivery
+// for every webhook they match. The cursor row is locked for the whole
+// transaction, so only one replica dispatches at a time and every event is
+// dispatched once. It reports whether there may be more events to read.
+func dispatch(db *sqlx.DB) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	cursor := queue.EventCursor{}
+	err = tx.Get(&cursor, `
+		SELECT CAST(txid AS TEXT) AS txid, event_id AS id FROM webhook_cursor
+		FOR UPDATE SKIP LOCKED;
+	`)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// another replica is dispatching
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to lock webhook cursor: %w", err)
+	}
+
+	events, err := queue.ReadEvents(tx, &cursor, eventBatchSize)
+	if err != nil {
+		return false, err
+	}
+	if len(events) == 0 {
+		return false, nil
+	}
+
+	webhooks := []models.Webhook{}
+	err = tx.Select(&webhooks, "SELECT * FROM webhook WHERE NOT paused")
+	if err != nil {
+		return false, fmt.Errorf("failed to query webhooks: %w", err)
+	}
+
+	for _, event := range events {
+		// progress is reported too often to be worth a request each time
+		if event.Event == "progress" {
+			continue
+		}
+
+		var payload []byte
+		for _, webhook := range webhooks {
+			filter := queue.EventFilter{Types: webhook.Types, States: webhook.States}
+			if !filter.Matches(event) {
+				continue
+			}
+			if payload == nil {
+				payload, err = newPayload(event)
+				if err != nil {
+					return false, fmt.Errorf("failed to encode payload: %w", err)
+				}
+			}
+
+			_, err = tx.Exec(`
+				INSERT INTO webhook_delivery (webhook_id, event_id, event, payload)
+				VALUES ($1, $2, $3, $4);
+			`, webhook.ID, event.ID, "job."+event.Event, string(payload))
+			if err != nil {
+				return false, fmt.Errorf("failed to queue delivery: %w", err)
+			}
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE webhook_cursor SET txid = CAST($1 AS XID8), event_id = $2;
+	`, cursor.TxID, cursor.ID)
+	if err != nil {
+		return false, fmt.Errorf("failed to advance webhook cursor: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return len(events) == eventBatchSize, nil
+}
+
+type dueDelivery struct {
+	models.WebhookDelivery
+	URL    string `db:"url"`
+	Secret string `db:"secret"`
+}
+
+// claim takes up to sendBatchSize due deliveries for sending. Their next
+// attempt is pushed back by claimTimeout before the transaction commits, so
+// no other replica picks them up while they are being sent, and a delivery
+// whose replica dies while sending it is retried afterwards. No lock is
+// held while the requests are in flight.
+func claim(db *sqlx.DB) ([]dueDelivery, error) {
+	deliveries := []dueDelivery{}
+	err := db.Select(&deliveries, `
+		UPDATE webhook_delivery AS d
+		SET next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $1)
+		FROM (
+			SELECT d.id, w.url, w.secret
+			FROM webhook_delivery AS d
+			JOIN webhook AS w ON w.id = d.webhook_id
+			WHERE d.state = 'pending' AND d.next_attempt_at <= CURRENT_TIMESTAMP AND NOT w.paused
+			ORDER BY d.next_attempt_at ASC
+			LIMIT $2
+			FOR UPDATE OF d SKIP LOCKED
+		) AS due
+		WHERE d.id = due.id
+		RETURNING d.*, due.url, due.secret;
+	`, claimTimeout.Seconds(), sendBatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim due deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// record logs an attempt of a delivery and moves the delivery on. A failed
+// delivery is retried with exponential backoff until maxAttempts is
+// reached. A delivery that was deleted in the meantime is left alone.
+func record(db *sqlx.DB, delivery *dueDelivery, statusCode *int, deliveryErr error, duration time.Duration) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var message *string
+	if deliveryErr != nil {
+		text := deliveryErr.Error()
+		message = &text
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO webhook_attempt (delivery_id, attempt, status_code, error, duration_ms)
+		SELECT id, (SELECT COUNT(*) + 1 FROM webhook_attempt WHERE delivery_id = $1), $2, $3, $4
+		FROM webhook_delivery
+		WHERE id = $1;
+	`, delivery.ID, statusCode, message, duration.Milliseconds())
+	if err != nil {
+		return fmt.Errorf("failed to log delivery attempt: %w", err)
+	}
+
+	attempts := delivery.Attempts + 1
+	if deliveryErr == nil {
+		_, err = tx.Exec(`
+			UPDATE webhook_delivery
+			SET state = 'delivered', attempts = $1, next_attempt_at = NULL, last_error = NULL
+			WHERE id = $2;
+		`, attempts, delivery.ID)
+	} else {
+		state := DELIVERY_PENDING
+		if attempts >= maxAttempts {
+			state = DELIVERY_FAILED
+		}
+		delay := backoff * time.Duration(1<<(attempts-1))
+		_, err = tx.Exec(`
+			UPDATE webhook_delivery
+			SET state = $1, attempts = $2,
+				next_attempt_at = CASE WHEN $1 = 'pending' THEN CURRENT_TIMESTAMP + make_interval(secs => $3) END,
+				last_error = $4
+			WHERE id = $5;
+		`, state, attempts, delay.Seconds(), *message, delivery.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update delivery: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// send sends due deliveries and logs every attempt. It reports whether
+// there may be more deliveries due.
+func send(db *sqlx.DB) (bool, error) {
+	deliveries, err := claim(db)
+	if err != nil {
+		return false, err
+	}
+
+	for _, delivery := range deliveries {
+		started := time.Now()
+		statusCode, deliveryErr := post(&delivery)
+		duration := time.Since(started)
+		if deliveryErr != nil {
+			slog.Warn("Failed to deliver webhook", "webhook", delivery.WebhookID, "delivery", delivery.ID, "err", deliveryErr)
+		}
+
+		err = record(db, &delivery, statusCode, deliveryErr, duration)
+		if err != nil {
+			return false, err
+		}
+	}
+	return len(deliveries) == sendBatchSize, nil
+}
+
+// post sends a delivery to its webhook and returns the status code of the
+// response, if there was one. Any response other than 2xx counts as a
+// failure.
+func post(delivery *dueDelivery) (*int, error) {
+	request, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "jobledger-webhook")
+	request.Header.Set("X-Jobledger-Event", delivery.Event)
+	request.Header.Set("X-Jobledger-Delivery", strconv.FormatInt(delivery.ID, 10))
+	request.Header.Set(signature.Header, signature.Sign(delivery.Secret, time.Now(), delivery.Payload))
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, maxResponseBytes))
+		if len(body) > 0 {
+			return &response.StatusCode, fmt.Errorf("webhook responded with %s: %s", response.Status, body)
+		}
+		return &response.StatusCode, fmt.Errorf("webhook responded with %s", response.Status)
+	}
+	return &response.StatusCode, nil
+}
+
+// deleteExpiredDeliveries deletes finished deliveries that are older than
+// the event retention.
+func deleteExpiredDeliveries(db *sqlx.DB) (int64, error) {
+	if queue.EventRetention == 0 {
+		return 0, nil
+	}
+
+	result, err := db.Exec(`
+		DELETE FROM webhook_delivery
+		WHERE state <> 'pending' AND created_at < CURRENT_TIMESTAMP - make_interval(secs => $1);
+	`, queue.EventRetention.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired deliveries: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// tick dispatches new events and sends the deliveries that are due.
+func tick(db *sqlx.DB) {
+	for more := true; more; {
+		var err error
+		more, err = dispatch(db)
+		if err != nil {
+			slog.Error("Failed to dispatch webhooks", "webhook", "dispatch", "err", err)
+			break
+		}
+	}
+
+	for more := true; more; {
+		var err error
+		more, err = send(db)
+		if err != nil {
+			slog.Error("Failed to send webhooks", "webhook", "send", "err", err)
+			break
+		}
+	}
+}
+
+// Run delivers job events to webhooks. It runs whenever events are written
+// and periodically for retries. It never returns and is meant to be started
+// in a goroutine. It is safe to run on every server replica.
+func Run(db *sqlx.DB) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	initialized := false
+	for {
+		woken := queue.EventsAdded()
+
+		if !initialized {
+			err := initCursor(db)
+			if err != nil {
+				slog.Error("Failed to initialize webhooks", "webhook", "dispatch", "err", err)
+			}
+			initialized = err == nil
+		}
+		tick(db)
+
+		select {
+		case <-woken:
+		case <-ticker.C:
+			deleted, err := deleteExpiredDeliveries(db)
+			if err != nil {
+				slog.Error("Failed to delete expired deliveries", "webhook", "retention", "err", err)
+			} else if deleted > 0 {
+				slog.Info("Deleted expired deliveries", "webhook", "retention", "count", deleted)
+			}
+		}
+	}
+}
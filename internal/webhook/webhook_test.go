@@ -0,0 +1,58 @@
+package webhook
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/dusansimic/jobledger/internal/signature"
+)
+
+// verify checks a signature header the way the README tells receivers to.
+func verify(header string, secret string, body []byte, now time.Time) bool {
+	timestamp, _, _ := strings.Cut(strings.TrimPrefix(header, "t="), ",")
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || now.Sub(time.Unix(sent, 0)).Abs() > 5*time.Minute {
+		return false
+	}
+	return signature.Sign(secret, time.Unix(sent, 0), body) == header
+}
+
+func TestPost(t *testing.T) {
+	var header http.Header
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	delivery := &dueDelivery{
+		WebhookDelivery: models.WebhookDelivery{ID: 7, Event: "job.created", Payload: []byte(`{"event":"job.created"}`)},
+		URL:             server.URL,
+		Secret:          "whsec",
+	}
+	status, err := post(delivery)
+	if err != nil || status == nil || *status != http.StatusOK {
+		t.Fatalf("post = %v, %v, want 200", status, err)
+	}
+
+	if header.Get("X-Jobledger-Delivery") != "7" || header.Get("X-Jobledger-Event") != "job.created" {
+		t.Errorf("delivery headers = %v", header)
+	}
+	sig := header.Get("X-Jobledger-Signature")
+	if !verify(sig, "whsec", body, time.Now()) {
+		t.Errorf("signature %q doesn't verify", sig)
+	}
+	if verify(sig, "whsec", body, time.Now().Add(10*time.Minute)) {
+		t.Errorf("signature %q still verifies 10 minutes later", sig)
+	}
+	if verify(sig, "whsec", []byte(`{"event":"job.deleted"}`), time.Now()) {
+		t.Errorf("signature %q verifies another body", sig)
+	}
+}
@@ -0,0 +1,197 @@
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"text/template"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/dusansimic/jobledger/internal/queue"
+)
+
+var ErrInvalidWorkflow = errors.New("invalid workflow")
+
+// Definition is a named DAG of jobs. Every node becomes a job when the
+// workflow is started, its dependencies become dependencies between the
+// jobs.
+//
+//	{"nodes": [
+//	  {"key": "build", "type": "docker.build", "metadata": {"tag": "{{ .Inputs.version }}"}},
+//	  {"key": "deploy", "type": "deploy", "depends_on": ["build"]}
+//	]}
+type Definition struct {
+	Nodes []Node `json:"nodes"`
+}
+
+// Node is a job of a workflow. Name and string values in metadata are
+// templates rendered with TemplateData when the workflow is started.
+type Node struct {
+	Key          string             `json:"key"`
+	Name         string             `json:"name"`
+	Type         string             `json:"type"`
+	Metadata     models.MetadataMap `json:"metadata"`
+	MaxAttempts  *int               `json:"max_attempts"`
+	Backoff      *string            `json:"backoff"`
+	BackoffDelay *int               `json:"backoff_delay"`
+	Priority     int                `json:"priority"`
+	DependsOn    []Edge             `json:"depends_on"`
+}
+
+// Edge is a dependency of a node on another node of the same workflow. In
+// JSON it is either the key of the other node or an object such as
+// {"node": "test", "on_failure": "ignore"}.
+type Edge struct {
+	Node      string `json:"node"`
+	OnFailure string `json:"on_failure"`
+}
+
+func (e *Edge) UnmarshalJSON(data []byte) error {
+	var node string
+	if err := json.Unmarshal(data, &node); err == nil {
+		*e = Edge{Node: node}
+		return nil
+	}
+
+	type edge Edge
+	return json.Unmarshal(data, (*edge)(e))
+}
+
+// TemplateData is available to the name and metadata templates of the
+// nodes, e.g. {{ .Inputs.version }} or {{ .Run }}.
+type TemplateData struct {
+	Inputs   map[string]any
+	Workflow string
+	Run      int
+}
+
+// Parse decodes and validates a workflow definition.
+func Parse(data []byte) (Definition, error) {
+	definition := Definition{}
+	err := json.Unmarshal(data, &definition)
+	if err != nil {
+		return definition, fmt.Errorf("%w: %w", ErrInvalidWorkflow, err)
+	}
+	return definition, definition.Validate()
+}
+
+// Validate checks that node keys are unique, dependencies point at other
+// nodes without forming a cycle and templates parse.
+func (d *Definition) Validate() error {
+	if len(d.Nodes) == 0 {
+		return fmt.Errorf("%w: a workflow needs at least one node", ErrInvalidWorkflow)
+	}
+
+	keys := map[string]bool{}
+	for _, node := range d.Nodes {
+		if node.Key == "" {
+			return fmt.Errorf("%w: every node needs a key", ErrInvalidWorkflow)
+		}
+		if keys[node.Key] {
+			return fmt.Errorf("%w: node %q is defined twice", ErrInvalidWorkflow, node.Key)
+		}
+		keys[node.Key] = true
+
+		if node.Type == "" {
+			return fmt.Errorf("%w: node %q needs a type", ErrInvalidWorkflow, node.Key)
+		}
+		_, err := template.New("").Parse(node.Name)
+		if err != nil {
+			return fmt.Errorf("%w: node %q: invalid name template: %w", ErrInvalidWorkflow, node.Key, err)
+		}
+		err = parseValue(map[string]any(node.Metadata))
+		if err != nil {
+			return fmt.Errorf("%w: node %q: invalid metadata template: %w", ErrInvalidWorkflow, node.Key, err)
+		}
+	}
+
+	for _, node := range d.Nodes {
+		for _, edge := range node.DependsOn {
+			if !keys[edge.Node] {
+				return fmt.Errorf("%w: node %q depends on unknown node %q", ErrInvalidWorkflow, node.Key, edge.Node)
+			}
+			if edge.OnFailure != "" && !queue.ValidDependencyPolicy(edge.OnFailure) {
+				return fmt.Errorf("%w: node %q: on_failure must be cancel, fail or ignore", ErrInvalidWorkflow, node.Key)
+			}
+		}
+	}
+
+	_, err := d.Order()
+	return err
+}
+
+// parseValue checks that every string in a metadata value is a valid
+// template.
+func parseValue(value any) error {
+	switch v := value.(type) {
+	case string:
+		_, err := template.New("").Parse(v)
+		return err
+	case map[string]any:
+		for _, item := range v {
+			if err := parseValue(item); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, item := range v {
+			if err := parseValue(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Order returns the nodes sorted so that every node comes after the nodes
+// it depends on. Nodes that don't depend on each other keep the order of
+// the definition.
+func (d *Definition) Order() ([]Node, error) {
+	placed := map[string]bool{}
+	ordered := make([]Node, 0, len(d.Nodes))
+
+	for len(ordered) < len(d.Nodes) {
+		progress := false
+		for _, node := range d.Nodes {
+			if placed[node.Key] || !d.ready(node, placed) {
+				continue
+			}
+			placed[node.Key] = true
+			ordered = append(ordered, node)
+			progress = true
+		}
+		if !progress {
+			return nil, fmt.Errorf("%w: dependencies form a cycle", ErrInvalidWorkflow)
+		}
+	}
+	return ordered, nil
+}
+
+func (d *Definition) ready(node Node, placed map[string]bool) bool {
+	for _, edge := range node.DependsOn {
+		if !placed[edge.Node] {
+			return false
+		}
+	}
+	return true
+}
+
+// Levels returns the depth of every node in the graph. Nodes without
+// dependencies are on level 0, every other node is one level below its
+// deepest dependency.
+func (d *Definition) Levels() map[string]int {
+	levels := map[string]int{}
+	ordered, err := d.Order()
+	if err != nil {
+		return levels
+	}
+
+	for _, node := range ordered {
+		level := 0
+		for _, edge := range node.DependsOn {
+			level = max(level, levels[edge.Node]+1)
+		}
+		levels[node.Key] = level
+	}
+	return levels
+}
@@ -0,0 +1,130 @@
+package workflow
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		error string
+	}{
+		{
+			name: "valid",
+			json: `{"nodes": [
+				{"key": "build", "type": "docker.build", "name": "build {{ .Inputs.version }}"},
+				{"key": "deploy", "type": "deploy", "depends_on": ["build", {"node": "test", "on_failure": "ignore"}]},
+				{"key": "test", "type": "test", "depends_on": ["build"]}
+			]}`,
+		},
+		{name: "no nodes", json: `{"nodes": []}`, error: "at least one node"},
+		{name: "missing key", json: `{"nodes": [{"type": "x"}]}`, error: "needs a key"},
+		{name: "duplicate key", json: `{"nodes": [{"key": "a", "type": "x"}, {"key": "a", "type": "y"}]}`, error: `"a" is defined twice`},
+		{name: "missing type", json: `{"nodes": [{"key": "a"}]}`, error: `"a" needs a type`},
+		{name: "unknown key", json: `{"nodes": [{"key": "a", "type": "x", "depends_on": ["b"]}]}`, error: `depends on unknown node "b"`},
+		{name: "invalid policy", json: `{"nodes": [{"key": "a", "type": "x"}, {"key": "b", "type": "x", "depends_on": [{"node": "a", "on_failure": "retry"}]}]}`, error: "on_failure"},
+		{name: "self cycle", json: `{"nodes": [{"key": "a", "type": "x", "depends_on": ["a"]}]}`, error: "cycle"},
+		{
+			name: "cycle",
+			json: `{"nodes": [
+				{"key": "a", "type": "x"},
+				{"key": "b", "type": "x", "depends_on": ["a", "d"]},
+				{"key": "c", "type": "x", "depends_on": ["b"]},
+				{"key": "d", "type": "x", "depends_on": ["c"]}
+			]}`,
+			error: "cycle",
+		},
+		{name: "invalid name template", json: `{"nodes": [{"key": "a", "type": "x", "name": "{{ .Inputs"}]}`, error: "invalid name template"},
+		{name: "invalid metadata template", json: `{"nodes": [{"key": "a", "type": "x", "metadata": {"tags": ["{{ end }}"]}}]}`, error: "invalid metadata template"},
+		{name: "malformed", json: `{"nodes": {}}`, error: "cannot unmarshal"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse([]byte(test.json))
+			if test.error == "" {
+				if err != nil {
+					t.Fatalf("Parse: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidWorkflow) || !strings.Contains(err.Error(), test.error) {
+				t.Fatalf("Parse = %v, want an invalid workflow error containing %q", err, test.error)
+			}
+		})
+	}
+}
+
+func TestOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		nodes  []Node
+		order  []string
+		levels map[string]int
+	}{
+		{
+			name:   "independent nodes keep their order",
+			nodes:  []Node{{Key: "c"}, {Key: "a"}, {Key: "b"}},
+			order:  []string{"c", "a", "b"},
+			levels: map[string]int{"a": 0, "b": 0, "c": 0},
+		},
+		{
+			name: "dependencies come first",
+			nodes: []Node{
+				{Key: "deploy", DependsOn: []Edge{{Node: "test"}, {Node: "build"}}},
+				{Key: "test", DependsOn: []Edge{{Node: "build"}}},
+				{Key: "build"},
+				{Key: "lint"},
+			},
+			order:  []string{"build", "lint", "test", "deploy"},
+			levels: map[string]int{"build": 0, "lint": 0, "test": 1, "deploy": 2},
+		},
+		{
+			name: "diamond",
+			nodes: []Node{
+				{Key: "join", DependsOn: []Edge{{Node: "left"}, {Node: "right"}}},
+				{Key: "right", DependsOn: []Edge{{Node: "root"}}},
+				{Key: "left", DependsOn: []Edge{{Node: "root"}}},
+				{Key: "root"},
+			},
+			order:  []string{"root", "right", "left", "join"},
+			levels: map[string]int{"root": 0, "left": 1, "right": 1, "join": 2},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			definition := Definition{Nodes: test.nodes}
+			ordered, err := definition.Order()
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys := make([]string, len(ordered))
+			for i, node := range ordered {
+				keys[i] = node.Key
+			}
+			if !reflect.DeepEqual(keys, test.order) {
+				t.Errorf("Order = %v, want %v", keys, test.order)
+			}
+			if levels := definition.Levels(); !reflect.DeepEqual(levels, test.levels) {
+				t.Errorf("Levels = %v, want %v", levels, test.levels)
+			}
+		})
+	}
+}
+
+func TestOrderCycle(t *testing.T) {
+	definition := Definition{Nodes: []Node{
+		{Key: "a", DependsOn: []Edge{{Node: "b"}}},
+		{Key: "b", DependsOn: []Edge{{Node: "a"}}},
+	}}
+	_, err := definition.Order()
+	if !errors.Is(err, ErrInvalidWorkflow) {
+		t.Fatalf("Order = %v, want ErrInvalidWorkflow", err)
+	}
+	if levels := definition.Levels(); len(levels) != 0 {
+		t.Errorf("Levels of a cycle = %v, want none", levels)
+	}
+}
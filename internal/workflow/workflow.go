@@ -0,0 +1,300 @@
+package workflow
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/dusansimic/jobledger/internal/models"
+	"github.com/dusansimic/jobledger/internal/queue"
+	"github.com/dusansimic/jobledger/internal/render"
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	ErrWorkflowNotFound = errors.New("workflow not found")
+	ErrRunNotFound      = errors.New("workflow run not found")
+)
+
+// Save creates a workflow or replaces the definition of an existing one.
+// Runs that were already started keep the definition they started from.
+func Save(db *sqlx.DB, name string, definition Definition) (*models.Workflow, error) {
+	if name == "" {
+		return nil, fmt.Errorf("%w: a workflow needs a name", ErrInvalidWorkflow)
+	}
+	err := definition.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := json.Marshal(definition)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode definition: %w", err)
+	}
+
+	workflow := models.Workflow{}
+	err = db.Get(&workflow, `
+		INSERT INTO workflow (name, definition)
+		VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE
+		SET definition = EXCLUDED.definition, updated_at = CURRENT_TIMESTAMP
+		RETURNING *;
+	`, name, string(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("failed to save workflow: %w", err)
+	}
+	return &workflow, nil
+}
+
+// Get returns a workflow by its name.
+func Get(db *sqlx.DB, name string) (*models.Workflow, error) {
+	workflow := models.Workflow{}
+	err := db.Get(&workflow, "SELECT * FROM workflow WHERE name = $1", name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrWorkflowNotFound
+		}
+		return nil, fmt.Errorf("failed to query workflow: %w", err)
+	}
+	return &workflow, nil
+}
+
+// List returns all workflows ordered by name.
+func List(db *sqlx.DB) ([]models.Workflow, error) {
+	workflows := []models.Workflow{}
+	err := db.Select(&workflows, "SELECT * FROM workflow ORDER BY name ASC")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query workflows: %w", err)
+	}
+	return workflows, nil
+}
+
+// Delete deletes a workflow. Its runs and their jobs are kept.
+func Delete(db *sqlx.DB, name string) error {
+	result, err := db.Exec("DELETE FROM workflow WHERE name = $1", name)
+	if err != nil {
+		return fmt.Errorf("failed to delete workflow: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrWorkflowNotFound
+	}
+	return nil
+}
+
+// Start creates a run of a workflow with the given inputs. Every node is
+// rendered and enqueued in one transaction, with the dependencies between
+// nodes turned into dependencies between their jobs.
+func Start(db *sqlx.DB, name string, inputs models.MetadataMap) (*models.WorkflowRun, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	workflow := models.Workflow{}
+	err = tx.Get(&workflow, "SELECT * FROM workflow WHERE name = $1 FOR SHARE", name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrWorkflowNotFound
+		}
+		return nil, fmt.Errorf("failed to query workflow: %w", err)
+	}
+
+	definition, err := Parse(workflow.Definition)
+	if err != nil {
+		return nil, err
+	}
+	ordered, err := definition.Order()
+	if err != nil {
+		return nil, err
+	}
+
+	run := models.WorkflowRun{}
+	err = tx.Get(&run, `
+		INSERT INTO workflow_run (workflow_id, workflow_name, definition, inputs)
+		VALUES ($1, $2, $3, $4)
+		RETURNING *;
+	`, workflow.ID, workflow.Name, string(workflow.Definition), inputs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert workflow run: %w", err)
+	}
+
+	data := TemplateData{
+		Inputs:   map[string]any(inputs),
+		Workflow: workflow.Name,
+		Run:      run.ID,
+	}
+
+	jobIDs := map[string]int{}
+	for _, node := range ordered {
+		job, err := newJob(node, data, jobIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		created, _, err := queue.EnqueueTx(tx, job)
+		if err != nil {
+			if errors.Is(err, queue.ErrInvalidJob) {
+				return nil, fmt.Errorf("%w: node %q: %w", ErrInvalidWorkflow, node.Key, err)
+			}
+			return nil, err
+		}
+		jobIDs[node.Key] = created.ID
+
+		_, err = tx.Exec(`
+			UPDATE job SET workflow_run_id = $1, workflow_node = $2 WHERE id = $3;
+		`, run.ID, node.Key, created.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to link job to workflow run: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return &run, nil
+}
+
+// newJob renders a node into the job it is enqueued as. jobIDs holds the
+// jobs of the nodes enqueued so far.
+func newJob(node Node, data TemplateData, jobIDs map[string]int) (queue.NewJob, error) {
+	name := node.Key
+	if node.Name != "" {
+		rendered, err := render.String(node.Name, data)
+		if err != nil {
+			return queue.NewJob{}, fmt.Errorf("%w: node %q: failed to render name: %w", ErrInvalidWorkflow, node.Key, err)
+		}
+		name = rendered
+	}
+
+	var metadata models.MetadataMap
+	if node.Metadata != nil {
+		rendered, err := render.Value(map[string]any(node.Metadata), data)
+		if err != nil {
+			return queue.NewJob{}, fmt.Errorf("%w: node %q: failed to render metadata: %w", ErrInvalidWorkflow, node.Key, err)
+		}
+		metadata = rendered.(map[string]any)
+	}
+
+	dependencies := make([]queue.Dependency, len(node.DependsOn))
+	for i, edge := range node.DependsOn {
+		dependencies[i] = queue.Dependency{
+			ID:        jobIDs[edge.Node],
+			OnFailure: edge.OnFailure,
+		}
+	}
+
+	return queue.NewJob{
+		Name:         name,
+		Type:         node.Type,
+		Metadata:     metadata,
+		MaxAttempts:  node.MaxAttempts,
+		Backoff:      node.Backoff,
+		BackoffDelay: node.BackoffDelay,
+		Priority:     node.Priority,
+		DependsOn:    dependencies,
+	}, nil
+}
+
+// NodeState is a node of a workflow run together with its job.
+type NodeState struct {
+	Node  Node        `json:"node"`
+	Level int         `json:"level"`
+	Job   *models.Job `json:"job"`
+}
+
+// RunState is a workflow run with the state of every node.
+type RunState struct {
+	Run   models.WorkflowRun `json:"run"`
+	State string             `json:"state"`
+	Nodes []NodeState        `json:"nodes,omitempty"`
+}
+
+// GetRun returns a workflow run with the jobs of its nodes. The state of
+// the run is running while any job has not finished, complete once all of
+// them completed and failed otherwise.
+func GetRun(db *sqlx.DB, id string) (*RunState, error) {
+	runID, err := strconv.Atoi(id)
+	if err != nil {
+		return nil, ErrRunNotFound
+	}
+
+	run := models.WorkflowRun{}
+	err = db.Get(&run, "SELECT * FROM workflow_run WHERE id = $1", runID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRunNotFound
+		}
+		return nil, fmt.Errorf("failed to query workflow run: %w", err)
+	}
+
+	jobs := []models.Job{}
+	err = db.Select(&jobs, "SELECT * FROM job WHERE workflow_run_id = $1 ORDER BY id ASC", runID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query workflow jobs: %w", err)
+	}
+	byNode := map[string]*models.Job{}
+	for i := range jobs {
+		if jobs[i].WorkflowNode != nil {
+			byNode[*jobs[i].WorkflowNode] = &jobs[i]
+		}
+	}
+
+	// the definition was valid when the run started
+	definition := Definition{}
+	err = json.Unmarshal(run.Definition, &definition)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode workflow definition: %w", err)
+	}
+	levels := definition.Levels()
+
+	state := runState(jobs)
+	nodes := make([]NodeState, len(definition.Nodes))
+	for i, node := range definition.Nodes {
+		nodes[i] = NodeState{
+			Node:  node,
+			Level: levels[node.Key],
+			Job:   byNode[node.Key],
+		}
+	}
+
+	return &RunState{Run: run, State: state, Nodes: nodes}, nil
+}
+
+// runState derives the state of a run from the states of its jobs.
+func runState(jobs []models.Job) string {
+	state := "complete"
+	for _, job := range jobs {
+		switch job.State {
+		case "complete":
+		case "cancelled", "deadletter":
+			state = "failed"
+		default:
+			return "running"
+		}
+	}
+	return state
+}
+
+// ListRuns returns the latest runs of all workflows, newest first.
+func ListRuns(db *sqlx.DB, limit int) ([]RunState, error) {
+	runs := []models.WorkflowRun{}
+	err := db.Select(&runs, "SELECT * FROM workflow_run ORDER BY id DESC LIMIT $1", limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query workflow runs: %w", err)
+	}
+
+	states := make([]RunState, len(runs))
+	for i, run := range runs {
+		jobs := []models.Job{}
+		err = db.Select(&jobs, "SELECT * FROM job WHERE workflow_run_id = $1", run.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query workflow jobs: %w", err)
+		}
+		states[i] = RunState{Run: run, State: runState(jobs)}
+	}
+	return states, nil
+}